@@ -0,0 +1,114 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/platolytics/platon-mk3/pkg/platon"
+	"github.com/spf13/cobra"
+)
+
+const (
+	fromArg  string = "from"
+	toArg    string = "to"
+	chunkArg string = "chunk"
+)
+
+// backfillCmd represents the backfill command
+var backfillCmd = &cobra.Command{
+	Use:   "backfill",
+	Short: "Populate cubes with historical data",
+	Long: `Backfill cubes for a historical range.
+
+The range is split into chunks small enough for a single Prometheus range
+query. Progress is checkpointed after every chunk, so re-running an
+interrupted backfill with the same range resumes where it stopped. An
+interrupted backfill exits with a non-zero code.
+
+Timestamps are RFC3339 or durations relative to the start of the current hour, e.g.
+
+platon backfill -c cube.yaml --from 720h
+platon backfill -c cube.yaml --from 2024-05-01T00:00:00Z --to 2024-05-31T00:00:00Z
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		cubeFile, _ := cmd.Flags().GetString(cubesArg)
+		if cubeFile == "" {
+			fmt.Printf("Please specify cubes YAML file using --%s.\n", cubesArg)
+			return
+		}
+		// Relative timestamps are based on the current hour, so a re-run
+		// within the same hour resolves to the same range and resumes.
+		now := time.Now().Truncate(time.Hour)
+		fromFlag, _ := cmd.Flags().GetString(fromArg)
+		if fromFlag == "" {
+			fmt.Printf("Please specify backfill start using --%s.\n", fromArg)
+			return
+		}
+		from, err := parseTimeArg(fromFlag, now)
+		if err != nil {
+			panic(err)
+		}
+		to := now
+		toFlag, _ := cmd.Flags().GetString(toArg)
+		if toFlag != "" {
+			to, err = parseTimeArg(toFlag, now)
+			if err != nil {
+				panic(err)
+			}
+		}
+		chunk, _ := cmd.Flags().GetDuration(chunkArg)
+
+		cubes, err := parseCubesFile(cubeFile)
+		if err != nil {
+			panic(err)
+		}
+		clickhouse, err := connectClickhouse(cmd)
+		if err != nil {
+			panic(err)
+		}
+		defer clickhouse.Connection.Close()
+		prometheus, err := prometheusConfig(cmd)
+		if err != nil {
+			panic(err)
+		}
+		options, err := platonOptions(cmd)
+		if err != nil {
+			panic(err)
+		}
+		ctx, stop := signalContext()
+		defer stop()
+		err = platon.Backfill(ctx, clickhouse, cubes, prometheus, options, from, to, chunk)
+		if errors.Is(err, context.Canceled) {
+			fmt.Println("Backfill interrupted, re-run with the same range to resume.")
+			clickhouse.Connection.Close()
+			os.Exit(1)
+		}
+		if err != nil {
+			panic(err)
+		}
+	},
+}
+
+// parseTimeArg parses an RFC3339 timestamp or a duration relative to now.
+func parseTimeArg(value string, now time.Time) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, value)
+	if err == nil {
+		return t, nil
+	}
+	d, durationErr := time.ParseDuration(value)
+	if durationErr != nil {
+		return time.Time{}, fmt.Errorf("can't parse %s as RFC3339 timestamp or duration: %w", value, err)
+	}
+	return now.Add(-1 * d), nil
+}
+
+func init() {
+	rootCmd.AddCommand(backfillCmd)
+	backfillCmd.Flags().StringP(cubesArg, "c", "", "File specifying cubes to backfill")
+	backfillCmd.Flags().String(fromArg, "", "Start of the backfilled range (RFC3339 or duration before now)")
+	backfillCmd.Flags().String(toArg, "", "End of the backfilled range (RFC3339 or duration before now, default now)")
+	backfillCmd.Flags().Duration(chunkArg, 0, "Length of the range queried at once (default: maximum allowed by Prometheus)")
+}
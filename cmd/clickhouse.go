@@ -0,0 +1,101 @@
+package cmd
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/platolytics/platon-mk3/pkg/db/clickhouse"
+	"github.com/spf13/cobra"
+)
+
+const (
+	clickhouseConfigArg             string = "clickhouse-config"
+	clickhouseAddrArg               string = "clickhouse-addr"
+	clickhouseDatabaseArg           string = "clickhouse-database"
+	clickhouseUsernameArg           string = "clickhouse-username"
+	clickhousePasswordArg           string = "clickhouse-password"
+	clickhousePasswordFileArg       string = "clickhouse-password-file"
+	clickhouseProtocolArg           string = "clickhouse-protocol"
+	clickhouseTLSArg                string = "clickhouse-tls"
+	clickhouseCAFileArg             string = "clickhouse-ca-file"
+	clickhouseInsecureSkipVerifyArg string = "clickhouse-insecure-skip-verify"
+	clickhouseDialTimeoutArg        string = "clickhouse-dial-timeout"
+	clickhouseReadTimeoutArg        string = "clickhouse-read-timeout"
+)
+
+var clickhouseSettings = []setting[clickhouse.Config]{
+	{clickhouseAddrArg, func(c *clickhouse.Config, v string) error {
+		c.Addr = strings.Split(v, ",")
+		return nil
+	}},
+	{clickhouseDatabaseArg, func(c *clickhouse.Config, v string) error { c.Database = v; return nil }},
+	{clickhouseUsernameArg, func(c *clickhouse.Config, v string) error { c.Username = v; return nil }},
+	{clickhousePasswordArg, func(c *clickhouse.Config, v string) error { c.Password = v; return nil }},
+	{clickhousePasswordFileArg, func(c *clickhouse.Config, v string) error { c.PasswordFile = v; return nil }},
+	{clickhouseProtocolArg, func(c *clickhouse.Config, v string) error { c.Protocol = v; return nil }},
+	{clickhouseTLSArg, func(c *clickhouse.Config, v string) (err error) {
+		c.TLS, err = strconv.ParseBool(v)
+		return
+	}},
+	{clickhouseCAFileArg, func(c *clickhouse.Config, v string) error { c.CAFile = v; return nil }},
+	{clickhouseInsecureSkipVerifyArg, func(c *clickhouse.Config, v string) (err error) {
+		c.InsecureSkipVerify, err = strconv.ParseBool(v)
+		return
+	}},
+	{clickhouseDialTimeoutArg, func(c *clickhouse.Config, v string) (err error) {
+		c.DialTimeout, err = time.ParseDuration(v)
+		return
+	}},
+	{clickhouseReadTimeoutArg, func(c *clickhouse.Config, v string) (err error) {
+		c.ReadTimeout, err = time.ParseDuration(v)
+		return
+	}},
+}
+
+// clickhouseConfig assembles the ClickHouse settings. Flags take precedence
+// over environment variables, which take precedence over the config file.
+func clickhouseConfig(cmd *cobra.Command) (clickhouse.Config, error) {
+	config := clickhouse.DefaultConfig()
+
+	configFile, _ := cmd.Flags().GetString(clickhouseConfigArg)
+	if !cmd.Flags().Changed(clickhouseConfigArg) {
+		configFile = os.Getenv(envName(clickhouseConfigArg))
+	}
+	if configFile != "" {
+		err := clickhouse.LoadConfigFile(configFile, &config)
+		if err != nil {
+			return config, err
+		}
+	}
+
+	err := applySettings(cmd, &config, clickhouseSettings)
+	return config, err
+}
+
+// connectClickhouse connects to ClickHouse using the settings of cmd.
+func connectClickhouse(cmd *cobra.Command) (clickhouse.Clickhouse, error) {
+	config, err := clickhouseConfig(cmd)
+	if err != nil {
+		return clickhouse.Clickhouse{}, err
+	}
+	return clickhouse.Connect(config)
+}
+
+func init() {
+	defaults := clickhouse.DefaultConfig()
+	flags := rootCmd.PersistentFlags()
+	flags.String(clickhouseConfigArg, "", "YAML file with ClickHouse connection settings")
+	flags.String(clickhouseAddrArg, strings.Join(defaults.Addr, ","), "Comma separated list of ClickHouse addresses")
+	flags.String(clickhouseDatabaseArg, defaults.Database, "ClickHouse database")
+	flags.String(clickhouseUsernameArg, "", "ClickHouse username")
+	flags.String(clickhousePasswordArg, "", "ClickHouse password")
+	flags.String(clickhousePasswordFileArg, "", "File containing the ClickHouse password")
+	flags.String(clickhouseProtocolArg, defaults.Protocol, "ClickHouse protocol (native or http)")
+	flags.Bool(clickhouseTLSArg, false, "Connect to ClickHouse using TLS")
+	flags.String(clickhouseCAFileArg, "", "CA bundle to verify the ClickHouse server certificate")
+	flags.Bool(clickhouseInsecureSkipVerifyArg, false, "Skip verification of the ClickHouse server certificate")
+	flags.Duration(clickhouseDialTimeoutArg, defaults.DialTimeout, "Timeout for connecting to ClickHouse")
+	flags.Duration(clickhouseReadTimeoutArg, defaults.ReadTimeout, "Timeout for reading from ClickHouse")
+}
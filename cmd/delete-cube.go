@@ -6,7 +6,6 @@ package cmd
 import (
 	"fmt"
 
-	"github.com/platolytics/platon-mk3/pkg/db/clickhouse"
 	"github.com/platolytics/platon-mk3/pkg/platon"
 	"github.com/spf13/cobra"
 )
@@ -31,11 +30,13 @@ to quickly create a Cobra application.`,
 		if err != nil {
 			panic(err)
 		}
-		clickhouse, err := clickhouse.Connect()
+		clickhouse, err := connectClickhouse(cmd)
 		if err != nil {
 			panic(err)
 		}
-		err = platon.DeleteCubes(clickhouse, cubes)
+		ctx, stop := signalContext()
+		defer stop()
+		err = platon.DeleteCubes(ctx, clickhouse, cubes)
 		if err != nil {
 			panic(err)
 		}
@@ -0,0 +1,50 @@
+package cmd
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/platolytics/platon-mk3/pkg/platon"
+	"github.com/spf13/cobra"
+)
+
+const (
+	discoveryWindowArg    string = "discovery-window"
+	discoveryBatchSizeArg string = "discovery-batch-size"
+	discoveryCacheDirArg  string = "discovery-cache-dir"
+	discoveryCacheTtlArg  string = "discovery-cache-ttl"
+)
+
+var discoverySettings = []setting[platon.DiscoveryConfig]{
+	{discoveryWindowArg, func(c *platon.DiscoveryConfig, v string) (err error) {
+		c.Window, err = time.ParseDuration(v)
+		return
+	}},
+	{discoveryBatchSizeArg, func(c *platon.DiscoveryConfig, v string) (err error) {
+		c.BatchSize, err = strconv.Atoi(v)
+		return
+	}},
+	{discoveryCacheDirArg, func(c *platon.DiscoveryConfig, v string) error { c.CacheDir = v; return nil }},
+	{discoveryCacheTtlArg, func(c *platon.DiscoveryConfig, v string) (err error) {
+		c.CacheTTL, err = time.ParseDuration(v)
+		return
+	}},
+}
+
+// discoveryConfig assembles the metric discovery settings from flags and PLATON_DISCOVERY_* environment variables.
+func discoveryConfig(cmd *cobra.Command) (platon.DiscoveryConfig, error) {
+	config := platon.DefaultDiscoveryConfig()
+	err := applySettings(cmd, &config, discoverySettings)
+	return config, err
+}
+
+func init() {
+	defaults := platon.DefaultDiscoveryConfig()
+	for _, c := range []*cobra.Command{listCmd, generateCmd} {
+		flags := c.PersistentFlags()
+		flags.Duration(discoveryWindowArg, defaults.Window, "Only discover metrics with series in this window before now")
+		flags.Int(discoveryBatchSizeArg, defaults.BatchSize, "Number of metrics whose series are requested at once")
+		flags.String(discoveryCacheDirArg, defaults.CacheDir, "Directory caching discovered metrics and labels")
+		flags.Duration(discoveryCacheTtlArg, defaults.CacheTTL, "How long discovered metrics and labels are cached, 0 disables the cache")
+	}
+}
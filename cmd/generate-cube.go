@@ -29,8 +29,15 @@ to quickly create a Cobra application.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		name, _ := cmd.Flags().GetString(nameArg)
 		metrics, _ := cmd.Flags().GetStringArray(dimensionsArg)
-		prometheusUrl, _ := cmd.Flags().GetString(PrometheusArg)
-		cube := platon.GenerateCube(name, metrics, prometheusUrl)
+		prometheus, err := prometheusConfig(cmd)
+		if err != nil {
+			panic(err)
+		}
+		discovery, err := discoveryConfig(cmd)
+		if err != nil {
+			panic(err)
+		}
+		cube := platon.GenerateCube(name, metrics, prometheus, discovery)
 		yamlBytes, err := yaml.Marshal(cube)
 		if err != nil {
 			panic(err)
@@ -23,9 +23,16 @@ Cobra is a CLI library for Go that empowers applications.
 This application is a tool to generate the needed files
 to quickly create a Cobra application.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		prometheusUrl, _ := cmd.Flags().GetString(PrometheusArg)
+		prometheus, err := prometheusConfig(cmd)
+		if err != nil {
+			panic(err)
+		}
 		metricsFilter, _ := cmd.Flags().GetStringArray(metricsFilterArg)
-		platon.PrintDimensions(metricsFilter, prometheusUrl)
+		discovery, err := discoveryConfig(cmd)
+		if err != nil {
+			panic(err)
+		}
+		platon.PrintDimensions(metricsFilter, prometheus, discovery)
 	},
 }
 
@@ -16,8 +16,15 @@ var metricsCmd = &cobra.Command{
 	Long:  ``,
 	Run: func(cmd *cobra.Command, args []string) {
 		dimensionFilter, _ := cmd.Flags().GetStringArray(dimensionsArg)
-		prometheusUrl, _ := cmd.Flags().GetString(PrometheusArg)
-		platon.PrintMetrics(dimensionFilter, prometheusUrl)
+		prometheus, err := prometheusConfig(cmd)
+		if err != nil {
+			panic(err)
+		}
+		discovery, err := discoveryConfig(cmd)
+		if err != nil {
+			panic(err)
+		}
+		platon.PrintMetrics(dimensionFilter, prometheus, discovery)
 	},
 }
 
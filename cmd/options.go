@@ -0,0 +1,31 @@
+package cmd
+
+import (
+	"strconv"
+
+	"github.com/platolytics/platon-mk3/pkg/platon"
+	"github.com/spf13/cobra"
+)
+
+const (
+	allowDestructiveArg string = "allow-destructive"
+)
+
+var optionsSettings = []setting[platon.Options]{
+	{allowDestructiveArg, func(o *platon.Options, v string) (err error) {
+		o.AllowDestructive, err = strconv.ParseBool(v)
+		return
+	}},
+}
+
+// platonOptions assembles the options controlling how ClickHouse is modified
+// from flags and PLATON_* environment variables.
+func platonOptions(cmd *cobra.Command) (platon.Options, error) {
+	options := platon.Options{}
+	err := applySettings(cmd, &options, optionsSettings)
+	return options, err
+}
+
+func init() {
+	rootCmd.PersistentFlags().Bool(allowDestructiveArg, false, "Apply schema migrations which can lose data, like column type changes and drops")
+}
@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/platolytics/platon-mk3/pkg/platon"
+	"github.com/spf13/cobra"
+)
+
+// planCmd represents the plan command
+var planCmd = &cobra.Command{
+	Use:   "plan",
+	Short: "Show what a sync would change without writing to ClickHouse",
+	Long: `Run the Prometheus queries and the join of every cube once and print
+the CREATE and ALTER statements which would be executed, the schema
+migrations of existing tables and the number of rows per table.
+
+Existing tables are read, but nothing is written to ClickHouse.
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		cubeFile, _ := cmd.Flags().GetString(cubesArg)
+		if cubeFile == "" {
+			fmt.Printf("Please specify cubes YAML file using --%s.\n", cubesArg)
+			os.Exit(1)
+		}
+		cubes, err := parseCubesFile(cubeFile)
+		if err != nil {
+			panic(err)
+		}
+		clickhouse, err := connectClickhouse(cmd)
+		if err != nil {
+			panic(err)
+		}
+		defer clickhouse.Connection.Close()
+		prometheus, err := prometheusConfig(cmd)
+		if err != nil {
+			panic(err)
+		}
+		options, err := platonOptions(cmd)
+		if err != nil {
+			panic(err)
+		}
+
+		ctx, stop := signalContext()
+		defer stop()
+		options.DryRun = true
+		summaries, planErr := platon.SyncOnce(ctx, clickhouse, cubes, prometheus, options)
+		platon.PrintPlan(summaries)
+		if planErr != nil {
+			fmt.Fprintln(os.Stderr, planErr)
+			clickhouse.Connection.Close()
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(planCmd)
+	planCmd.Flags().StringP(cubesArg, "c", "", "File specifying cubes to plan")
+}
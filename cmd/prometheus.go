@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"strconv"
+
+	"github.com/platolytics/platon-mk3/pkg/platon"
+	"github.com/spf13/cobra"
+)
+
+const (
+	prometheusBearerTokenArg        string = "prometheus-bearer-token"
+	prometheusBearerTokenFileArg    string = "prometheus-bearer-token-file"
+	prometheusUsernameArg           string = "prometheus-username"
+	prometheusPasswordArg           string = "prometheus-password"
+	prometheusPasswordFileArg       string = "prometheus-password-file"
+	prometheusCertFileArg           string = "prometheus-cert-file"
+	prometheusKeyFileArg            string = "prometheus-key-file"
+	prometheusCAFileArg             string = "prometheus-ca-file"
+	prometheusInsecureSkipVerifyArg string = "prometheus-insecure-skip-verify"
+	prometheusProxyURLArg           string = "prometheus-proxy-url"
+)
+
+var prometheusSettings = []setting[platon.PrometheusConfig]{
+	{PrometheusArg, func(c *platon.PrometheusConfig, v string) error { c.URL = v; return nil }},
+	{prometheusBearerTokenArg, func(c *platon.PrometheusConfig, v string) error { c.BearerToken = v; return nil }},
+	{prometheusBearerTokenFileArg, func(c *platon.PrometheusConfig, v string) error { c.BearerTokenFile = v; return nil }},
+	{prometheusUsernameArg, func(c *platon.PrometheusConfig, v string) error { c.Username = v; return nil }},
+	{prometheusPasswordArg, func(c *platon.PrometheusConfig, v string) error { c.Password = v; return nil }},
+	{prometheusPasswordFileArg, func(c *platon.PrometheusConfig, v string) error { c.PasswordFile = v; return nil }},
+	{prometheusCertFileArg, func(c *platon.PrometheusConfig, v string) error { c.CertFile = v; return nil }},
+	{prometheusKeyFileArg, func(c *platon.PrometheusConfig, v string) error { c.KeyFile = v; return nil }},
+	{prometheusCAFileArg, func(c *platon.PrometheusConfig, v string) error { c.CAFile = v; return nil }},
+	{prometheusInsecureSkipVerifyArg, func(c *platon.PrometheusConfig, v string) (err error) {
+		c.InsecureSkipVerify, err = strconv.ParseBool(v)
+		return
+	}},
+	{prometheusProxyURLArg, func(c *platon.PrometheusConfig, v string) error { c.ProxyURL = v; return nil }},
+}
+
+// prometheusConfig assembles the Prometheus settings from flags and PLATON_PROMETHEUS_* environment variables.
+func prometheusConfig(cmd *cobra.Command) (platon.PrometheusConfig, error) {
+	url, _ := cmd.Flags().GetString(PrometheusArg)
+	config := platon.PrometheusConfig{URL: url}
+	err := applySettings(cmd, &config, prometheusSettings)
+	return config, err
+}
+
+func init() {
+	flags := rootCmd.PersistentFlags()
+	flags.String(prometheusBearerTokenArg, "", "Bearer token sent to Prometheus")
+	flags.String(prometheusBearerTokenFileArg, "", "File containing the bearer token sent to Prometheus, e.g. /var/run/secrets/kubernetes.io/serviceaccount/token")
+	flags.String(prometheusUsernameArg, "", "Prometheus basic auth username")
+	flags.String(prometheusPasswordArg, "", "Prometheus basic auth password")
+	flags.String(prometheusPasswordFileArg, "", "File containing the Prometheus basic auth password")
+	flags.String(prometheusCertFileArg, "", "Client certificate for Prometheus mTLS")
+	flags.String(prometheusKeyFileArg, "", "Client key for Prometheus mTLS")
+	flags.String(prometheusCAFileArg, "", "CA bundle to verify the Prometheus server certificate")
+	flags.Bool(prometheusInsecureSkipVerifyArg, false, "Skip verification of the Prometheus server certificate")
+	flags.String(prometheusProxyURLArg, "", "HTTP proxy for Prometheus requests (default from HTTP_PROXY/HTTPS_PROXY)")
+}
@@ -1,10 +1,13 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
-	"github.com/platolytics/platon-mk3/pkg/db/clickhouse"
 	"github.com/platolytics/platon-mk3/pkg/platon"
 	"github.com/spf13/cobra"
 	"gopkg.in/yaml.v2"
@@ -27,12 +30,18 @@ cubes:
   - metric2{pod=abc}
   name: apiserver-resource-usage
   description: API Server resource usage Analysis
+
+The cubes file is reloaded when it changes or on SIGHUP. Invalid changes are
+rejected and the last valid configuration keeps running.
 `,
 	Run: RunRun,
 }
 
 const (
-	cubesArg string = "cubes"
+	cubesArg   string = "cubes"
+	workersArg string = "workers"
+
+	cubesFilePollInterval = 10 * time.Second
 )
 
 func RunRun(cmd *cobra.Command, args []string) {
@@ -45,13 +54,26 @@ func RunRun(cmd *cobra.Command, args []string) {
 	if err != nil {
 		panic(err)
 	}
-	clickhouse, err := clickhouse.Connect()
+	clickhouse, err := connectClickhouse(cmd)
 	if err != nil {
 		panic(err)
 	}
 	defer clickhouse.Connection.Close()
-	prometheusUrl, _ := cmd.Flags().GetString(PrometheusArg)
-	platon.WatchCubes(clickhouse, cubes, prometheusUrl)
+	prometheus, err := prometheusConfig(cmd)
+	if err != nil {
+		panic(err)
+	}
+	options, err := platonOptions(cmd)
+	if err != nil {
+		panic(err)
+	}
+	workers, _ := cmd.Flags().GetInt(workersArg)
+
+	ctx, stop := signalContext()
+	defer stop()
+	reloads := make(chan platon.Cubes)
+	go watchCubesFile(ctx, cubeFile, reloads)
+	platon.WatchCubes(ctx, clickhouse, cubes, prometheus, options, workers, reloads)
 }
 
 func parseCubesFile(cubeFile string) (cubes platon.Cubes, err error) {
@@ -66,10 +88,60 @@ func parseCubesFile(cubeFile string) (cubes platon.Cubes, err error) {
 		err = fmt.Errorf("can't parse cube file: %w", err)
 		return
 	}
+	err = cubes.Validate()
+	if err != nil {
+		err = fmt.Errorf("invalid cube file: %w", err)
+		return
+	}
 	return
 }
 
+// watchCubesFile re-reads the cubes file when it changes on disk or on SIGHUP
+// and sends the parsed cubes to reloads. Invalid files are rejected, so the
+// scheduler keeps running the last good configuration.
+func watchCubesFile(ctx context.Context, cubeFile string, reloads chan<- platon.Cubes) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	ticker := time.NewTicker(cubesFilePollInterval)
+	defer ticker.Stop()
+
+	lastModified := time.Time{}
+	if info, err := os.Stat(cubeFile); err == nil {
+		lastModified = info.ModTime()
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+			fmt.Printf("Received SIGHUP, reloading %s.\n", cubeFile)
+		case <-ticker.C:
+			info, err := os.Stat(cubeFile)
+			if err != nil || info.ModTime().Equal(lastModified) {
+				continue
+			}
+			lastModified = info.ModTime()
+			fmt.Printf("%s changed, reloading.\n", cubeFile)
+		}
+
+		cubes, err := parseCubesFile(cubeFile)
+		if err != nil {
+			fmt.Printf("Rejecting cubes file, keeping last good configuration: %v\n", err)
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case reloads <- cubes:
+		}
+	}
+}
+
 func init() {
 	rootCmd.AddCommand(runCmd)
 	runCmd.Flags().StringP(cubesArg, "c", "", "File specifying cubes to build and sync")
+	runCmd.Flags().IntP(workersArg, "w", platon.DefaultWorkers, "Maximum number of cubes updated concurrently")
 }
@@ -0,0 +1,39 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// setting applies the value of a flag or its environment variable to a config.
+type setting[C any] struct {
+	flag  string
+	apply func(config *C, value string) error
+}
+
+// envName returns the environment variable of a flag, e.g. PLATON_CLICKHOUSE_ADDR.
+func envName(flag string) string {
+	return "PLATON_" + strings.ToUpper(strings.ReplaceAll(flag, "-", "_"))
+}
+
+// applySettings overrides config with environment variables and then with
+// explicitly set flags, so flags take precedence over the environment.
+func applySettings[C any](cmd *cobra.Command, config *C, settings []setting[C]) error {
+	for _, s := range settings {
+		value, ok := os.LookupEnv(envName(s.flag))
+		if cmd.Flags().Changed(s.flag) {
+			value, ok = cmd.Flags().Lookup(s.flag).Value.String(), true
+		}
+		if !ok {
+			continue
+		}
+		err := s.apply(config, value)
+		if err != nil {
+			return fmt.Errorf("invalid value %q for %s: %w", value, s.flag, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/platolytics/platon-mk3/pkg/platon"
+	"github.com/spf13/cobra"
+)
+
+const (
+	onceArg        string = "once"
+	dryRunArg      string = "dry-run"
+	summaryFileArg string = "summary-file"
+)
+
+// syncCmd represents the sync command
+var syncCmd = &cobra.Command{
+	Use:   "sync",
+	Short: "Sync all cubes once and exit",
+	Long: `Sync every cube once from its stored watermark until now and exit.
+
+Intended for Kubernetes CronJobs and CI pipelines. A JSON summary with the
+rows fetched and inserted per query is written to stdout or --summary-file.
+If the summary is written to stdout, all progress output goes to stderr.
+The exit code is non-zero if any cube failed to sync.
+
+With --once=false, sync keeps running on the cubes' scrape intervals like run.
+With --dry-run, nothing is written to ClickHouse, see plan. --dry-run requires
+--once, since a dry run never advances the watermarks.
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		once, _ := cmd.Flags().GetBool(onceArg)
+		dryRun, _ := cmd.Flags().GetBool(dryRunArg)
+		if !once && dryRun {
+			fmt.Printf("--%s can't be combined with --%s=false.\n", dryRunArg, onceArg)
+			os.Exit(1)
+		}
+		if !once {
+			RunRun(cmd, args)
+			return
+		}
+		summaryFile, _ := cmd.Flags().GetString(summaryFileArg)
+		stdout := os.Stdout
+		if summaryFile == "" {
+			// Keep stdout parseable as JSON, everything printed while syncing goes to stderr
+			os.Stdout = os.Stderr
+		}
+		cubeFile, _ := cmd.Flags().GetString(cubesArg)
+		if cubeFile == "" {
+			fmt.Printf("Please specify cubes YAML file using --%s.\n", cubesArg)
+			os.Exit(1)
+		}
+		cubes, err := parseCubesFile(cubeFile)
+		if err != nil {
+			panic(err)
+		}
+		clickhouse, err := connectClickhouse(cmd)
+		if err != nil {
+			panic(err)
+		}
+		defer clickhouse.Connection.Close()
+		prometheus, err := prometheusConfig(cmd)
+		if err != nil {
+			panic(err)
+		}
+		options, err := platonOptions(cmd)
+		if err != nil {
+			panic(err)
+		}
+
+		ctx, stop := signalContext()
+		defer stop()
+		options.DryRun = dryRun
+		summaries, syncErr := platon.SyncOnce(ctx, clickhouse, cubes, prometheus, options)
+
+		summaryJson, err := json.MarshalIndent(summaries, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+		if summaryFile != "" {
+			err = os.WriteFile(summaryFile, summaryJson, 0644)
+			if err != nil {
+				panic(err)
+			}
+		} else {
+			fmt.Fprintln(stdout, string(summaryJson))
+		}
+
+		if syncErr != nil {
+			fmt.Fprintln(os.Stderr, syncErr)
+			clickhouse.Connection.Close()
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(syncCmd)
+	syncCmd.Flags().StringP(cubesArg, "c", "", "File specifying cubes to build and sync")
+	syncCmd.Flags().Bool(onceArg, true, "Sync each cube once and exit")
+	syncCmd.Flags().Bool(dryRunArg, false, "Print the statements and row counts instead of writing to ClickHouse")
+	syncCmd.Flags().String(summaryFileArg, "", "Write the JSON summary to this file instead of stdout")
+	syncCmd.Flags().IntP(workersArg, "w", platon.DefaultWorkers, "Maximum number of cubes updated concurrently (with --once=false)")
+}
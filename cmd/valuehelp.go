@@ -36,8 +36,11 @@ to quickly create a Cobra application.`,
 			fmt.Printf("Please specify dimension with --%s.\n", dimensionArg)
 			return
 		}
-		prometheusUrl, _ := cmd.Flags().GetString(PrometheusArg)
-		platon.ValueHelp(metric, dimension, prometheusUrl)
+		prometheus, err := prometheusConfig(cmd)
+		if err != nil {
+			panic(err)
+		}
+		platon.ValueHelp(metric, dimension, prometheus)
 	},
 }
 
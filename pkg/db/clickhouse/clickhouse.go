@@ -2,26 +2,73 @@ package clickhouse
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/ClickHouse/clickhouse-go/v2"
 	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	ProtocolNative = "native"
+	ProtocolHTTP   = "http"
 )
 
 type Clickhouse struct {
 	Connection driver.Conn
 }
 
-func Connect() (Clickhouse, error) {
-	ch := Clickhouse{}
-	ctx := context.Background()
-	conn, err := clickhouse.Open(&clickhouse.Options{
-		Protocol: clickhouse.Native,
-		Addr:     []string{"localhost:9040"},
+// Config holds the connection settings of a ClickHouse server or cluster.
+type Config struct {
+	Addr               []string      `yaml:"addr"`
+	Database           string        `yaml:"database"`
+	Username           string        `yaml:"username"`
+	Password           string        `yaml:"password"`
+	PasswordFile       string        `yaml:"password-file"`
+	Protocol           string        `yaml:"protocol"`
+	TLS                bool          `yaml:"tls"`
+	CAFile             string        `yaml:"ca-file"`
+	InsecureSkipVerify bool          `yaml:"insecure-skip-verify"`
+	DialTimeout        time.Duration `yaml:"dial-timeout"`
+	ReadTimeout        time.Duration `yaml:"read-timeout"`
+}
+
+// DefaultConfig returns the settings of the local development setup started by make run-deps.
+func DefaultConfig() Config {
+	return Config{
+		Addr:        []string{"localhost:9040"},
+		Database:    "default",
+		Protocol:    ProtocolNative,
+		DialTimeout: 30 * time.Second,
+		ReadTimeout: 5 * time.Minute,
+	}
+}
+
+// LoadConfigFile overrides the settings in config with the ones set in a YAML file.
+func LoadConfigFile(path string, config *Config) error {
+	yamlFile, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("can't read clickhouse config file: %w", err)
+	}
+	err = yaml.UnmarshalStrict(yamlFile, config)
+	if err != nil {
+		return fmt.Errorf("can't parse clickhouse config file: %w", err)
+	}
+	return nil
+}
+
+func (c Config) options() (*clickhouse.Options, error) {
+	options := &clickhouse.Options{
+		Addr: c.Addr,
 		Auth: clickhouse.Auth{
-			Database: "default",
-			//Username: "",
-			//Password: "",
+			Database: c.Database,
+			Username: c.Username,
+			Password: c.Password,
 		},
 		ClientInfo: clickhouse.ClientInfo{
 			Products: []struct {
@@ -35,10 +82,72 @@ func Connect() (Clickhouse, error) {
 		Debugf: func(format string, v ...interface{}) {
 			fmt.Printf(format, v)
 		},
-		//TLS: &tls.Config{
-		//	InsecureSkipVerify: true,
-		//},
-	})
+		DialTimeout: c.DialTimeout,
+		ReadTimeout: c.ReadTimeout,
+	}
+
+	switch c.Protocol {
+	case ProtocolNative, "":
+		options.Protocol = clickhouse.Native
+	case ProtocolHTTP:
+		options.Protocol = clickhouse.HTTP
+	default:
+		return nil, fmt.Errorf("unknown clickhouse protocol %s, expected %s or %s", c.Protocol, ProtocolNative, ProtocolHTTP)
+	}
+
+	if c.PasswordFile != "" {
+		password, err := os.ReadFile(c.PasswordFile)
+		if err != nil {
+			return nil, fmt.Errorf("can't read clickhouse password file: %w", err)
+		}
+		options.Auth.Password = strings.TrimSpace(string(password))
+	}
+
+	if c.TLS {
+		tlsConfig := &tls.Config{
+			InsecureSkipVerify: c.InsecureSkipVerify,
+		}
+		if c.CAFile != "" {
+			ca, err := os.ReadFile(c.CAFile)
+			if err != nil {
+				return nil, fmt.Errorf("can't read clickhouse CA file: %w", err)
+			}
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+				return nil, fmt.Errorf("no certificates found in clickhouse CA file %s", c.CAFile)
+			}
+		}
+		options.TLS = tlsConfig
+	}
+
+	return options, nil
+}
+
+// AsyncInsertContext returns a context making inserts asynchronous on the
+// server side. Inserts still wait until the data has been flushed.
+func AsyncInsertContext(ctx context.Context) context.Context {
+	return clickhouse.Context(ctx, clickhouse.WithSettings(clickhouse.Settings{
+		"async_insert":          1,
+		"wait_for_async_insert": 1,
+	}))
+}
+
+// DeduplicationTokenContext returns a context making the server drop an
+// insert if an insert with the same token has been seen before.
+func DeduplicationTokenContext(ctx context.Context, token string) context.Context {
+	return clickhouse.Context(ctx, clickhouse.WithSettings(clickhouse.Settings{
+		"insert_deduplication_token": token,
+	}))
+}
+
+func Connect(config Config) (Clickhouse, error) {
+	ch := Clickhouse{}
+	ctx := context.Background()
+	options, err := config.options()
+	if err != nil {
+		return ch, err
+	}
+	conn, err := clickhouse.Open(options)
 
 	if err != nil {
 		return ch, err
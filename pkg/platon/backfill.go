@@ -0,0 +1,96 @@
+package platon
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/platolytics/platon-mk3/pkg/db/clickhouse"
+)
+
+// MaxPointsPerSeries is the maximum number of points Prometheus returns per series in a range query.
+const MaxPointsPerSeries = 11000
+
+// MaxChunk returns the longest range which can be queried with a single Prometheus range query.
+func MaxChunk(step time.Duration) time.Duration {
+	return step * (MaxPointsPerSeries - 1)
+}
+
+// Backfill syncs all cubes for the historical range between from and to in
+// chunks of at most chunk length. A chunk of zero uses the longest range
+// Prometheus can answer in a single query.
+func Backfill(ctx context.Context, clickhouse clickhouse.Clickhouse, cubes Cubes, prometheus PrometheusConfig, options Options, from, to time.Time, chunk time.Duration) error {
+	p := NewPlaton(prometheus)
+	p.Cubes = cubes
+	p.Database = clickhouse
+	p.Options = options
+
+	err := p.EnsureSyncStateTable(ctx)
+	if err != nil {
+		return err
+	}
+	err = p.EnsureSchemaHistoryTable(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, cube := range p.Cubes.Cubes {
+		err := p.BackfillCube(ctx, cube, from, to, chunk)
+		if err != nil {
+			return fmt.Errorf("failed to backfill cube %s: %w", cube.Name, err)
+		}
+	}
+	return nil
+}
+
+// BackfillCube syncs a cube chunk by chunk between from and to. After every
+// chunk a checkpoint is stored, so an interrupted backfill of the same range
+// resumes after the last completed chunk. Cancelling ctx stops the backfill
+// after the current table insert.
+func (p *Platon) BackfillCube(ctx context.Context, cube Cube, from, to time.Time, chunk time.Duration) error {
+	if !from.Before(to) {
+		return fmt.Errorf("backfill start %s is not before end %s", from, to)
+	}
+	step := cube.minStep()
+	if chunk <= 0 {
+		chunk = MaxChunk(step)
+	}
+
+	watermarks, err := p.GetSyncState(ctx, cube)
+	if err != nil {
+		return err
+	}
+	checkpointKey := backfillStateKey(from, to)
+	start := from
+	if checkpoint, ok := watermarks[checkpointKey]; ok && checkpoint.After(from) {
+		start = checkpoint.Add(step)
+		fmt.Printf("Resuming backfill of cube %s at %s.\n", cube.Name, start.Format(time.RFC3339))
+	}
+
+	for start.Before(to) {
+		end := start.Add(chunk)
+		if end.After(to) {
+			end = to
+		}
+		fmt.Printf("Backfilling cube %s from %s to %s.\n", cube.Name, start.Format(time.RFC3339), end.Format(time.RFC3339))
+
+		starts := map[string]time.Time{}
+		for _, q := range cube.Queries {
+			starts[q.Name] = start
+		}
+		_, err := p.syncCube(ctx, cube, starts, end, nil, false)
+		if err != nil {
+			return err
+		}
+		err = p.SetSyncState(context.WithoutCancel(ctx), cube.Name, checkpointKey, end)
+		if err != nil {
+			return err
+		}
+		start = end.Add(step)
+	}
+	return nil
+}
+
+func backfillStateKey(from, to time.Time) string {
+	return fmt.Sprintf("backfill %s/%s", from.UTC().Format(time.RFC3339), to.UTC().Format(time.RFC3339))
+}
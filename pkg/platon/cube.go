@@ -1,6 +1,9 @@
 package platon
 
 import (
+	"fmt"
+	"slices"
+	"strings"
 	"time"
 )
 
@@ -11,19 +14,287 @@ type Cubes struct {
 type Cube struct {
 	Name           string        `yaml:"name"`
 	Description    string        `yaml:"description"`
-	Ttl            time.Duration `yaml:"ttl"`
+	Ttl            time.Duration `yaml:"ttl,omitempty"`
 	ScrapeInterval time.Duration `yaml:"scrape-interval"`
 	Queries        []Query       `yaml:"queries"`
 	JoinedLabels   []string      `yaml:"joined-labels"`
-	LastUpdate     time.Time
+	// Engine, OrderBy and PartitionBy override the table engine, see TableOptions.
+	Engine      string   `yaml:"engine,omitempty"`
+	OrderBy     []string `yaml:"order-by,omitempty"`
+	PartitionBy string   `yaml:"partition-by,omitempty"`
+	// BatchSize is the number of rows sent per insert, AsyncInsert enables ClickHouse async inserts.
+	BatchSize   int  `yaml:"batch-size,omitempty"`
+	AsyncInsert bool `yaml:"async-insert,omitempty"`
+	// Dedup selects how re-syncs of a time window avoid duplicate rows, one of DedupStrategies.
+	Dedup string `yaml:"dedup,omitempty"`
+	// JoinStrategy selects how ambiguous rows are joined, one of JoinStrategies.
+	JoinStrategy string `yaml:"join-strategy,omitempty"`
+	// JoinMode selects whether queries are joined in memory or by a ClickHouse view, one of JoinModes.
+	JoinMode string `yaml:"join-mode,omitempty"`
+	// Version is recorded with every schema migration, it defaults to a hash of the cube.
+	Version string `yaml:"version,omitempty"`
+	// ColumnRenames maps old to new column names, renaming columns of existing tables instead of dropping them.
+	ColumnRenames map[string]string `yaml:"column-renames,omitempty"`
+	// DropColumns are dropped from existing tables. Columns missing from the
+	// synced data are kept, since a label may only be absent in some windows.
+	DropColumns []string `yaml:"drop-columns,omitempty"`
+	// Timezone of the Time column, the server's timezone if empty.
+	Timezone string `yaml:"timezone,omitempty"`
+	// Columns override the type and codec of single columns by name.
+	Columns map[string]ColumnConfig `yaml:"columns,omitempty"`
+	// LabelsMap stores labels in the LabelsColumn map instead of a column per
+	// label. Only joined labels and LabelColumns are stored as columns.
+	LabelsMap    bool     `yaml:"labels-map,omitempty"`
+	LabelColumns []string `yaml:"label-columns,omitempty"`
+	// Mode selects range or instant queries, one of Modes. Queries can override it.
+	Mode string `yaml:"mode,omitempty"`
+	// ReplaceSnapshot keeps only the latest snapshot of instant queries instead of appending it.
+	ReplaceSnapshot bool `yaml:"replace-snapshot,omitempty"`
+	// Step is the resolution and Timeout the evaluation timeout of the Prometheus queries.
+	// InitialLookback is the range synced when there is no sync state yet, and
+	// the sync window ends Offset before now, so late samples are included.
+	Step            time.Duration `yaml:"step,omitempty"`
+	Timeout         time.Duration `yaml:"timeout,omitempty"`
+	InitialLookback time.Duration `yaml:"initial-lookback,omitempty"`
+	Offset          time.Duration `yaml:"offset,omitempty"`
 	//labels         []string
 }
 
+// ColumnConfig overrides the ClickHouse type or compression codec of a column,
+// e.g. type Float32 or codec "Gorilla, ZSTD" for a metric.
+type ColumnConfig struct {
+	Type  string `yaml:"type,omitempty"`
+	Codec string `yaml:"codec,omitempty"`
+}
+
 type Query struct {
 	Name        string `yaml:"name"`
 	PromQL      string `yaml:"promql"`
 	Value       string `yaml:"value"`
 	Aggregation string `yaml:"aggregation"`
+	Mode        string `yaml:"mode,omitempty"`
+	// Step, Timeout, InitialLookback and Offset override the ones of the cube.
+	Step            time.Duration `yaml:"step,omitempty"`
+	Timeout         time.Duration `yaml:"timeout,omitempty"`
+	InitialLookback time.Duration `yaml:"initial-lookback,omitempty"`
+	Offset          time.Duration `yaml:"offset,omitempty"`
+}
+
+// Validate checks the cubes for configuration errors which would only surface while syncing.
+func (c Cubes) Validate() error {
+	names := []string{}
+	for _, cube := range c.Cubes {
+		if cube.Name == "" {
+			return fmt.Errorf("cube without name")
+		}
+		if slices.Contains(names, cube.Name) {
+			return fmt.Errorf("cube %s is defined more than once", cube.Name)
+		}
+		names = append(names, cube.Name)
+		if err := cube.Validate(); err != nil {
+			return fmt.Errorf("invalid cube %s: %w", cube.Name, err)
+		}
+	}
+	return nil
+}
+
+// Validate checks a single cube and its queries.
+func (c *Cube) Validate() error {
+	if err := validateIdentifier("cube", c.Name); err != nil {
+		return err
+	}
+	for _, label := range slices.Concat(c.JoinedLabels, c.LabelColumns) {
+		if err := validateIdentifier("label", label); err != nil {
+			return err
+		}
+	}
+	if c.ScrapeInterval < 0 {
+		return fmt.Errorf("negative scrape-interval %s", c.ScrapeInterval)
+	}
+	if c.Ttl < 0 {
+		return fmt.Errorf("negative ttl %s", c.Ttl)
+	}
+	if err := validateDurations(c.Step, c.Timeout, c.InitialLookback, c.Offset); err != nil {
+		return err
+	}
+	if c.BatchSize < 0 {
+		return fmt.Errorf("negative batch-size %d", c.BatchSize)
+	}
+	if c.Dedup != "" && !slices.Contains(DedupStrategies, c.Dedup) {
+		return fmt.Errorf("unknown dedup strategy %s, expected one of %v", c.Dedup, DedupStrategies)
+	}
+	if c.JoinStrategy != "" && !slices.Contains(JoinStrategies, c.JoinStrategy) {
+		return fmt.Errorf("unknown join strategy %s, expected one of %v", c.JoinStrategy, JoinStrategies)
+	}
+	if c.JoinMode != "" && !slices.Contains(JoinModes, c.JoinMode) {
+		return fmt.Errorf("unknown join mode %s, expected one of %v", c.JoinMode, JoinModes)
+	}
+	if c.Timezone != "" {
+		if _, err := time.LoadLocation(c.Timezone); err != nil {
+			return fmt.Errorf("unknown timezone %s: %w", c.Timezone, err)
+		}
+	}
+	for oldName, newName := range c.ColumnRenames {
+		if err := validateIdentifier("column", oldName); err != nil {
+			return err
+		}
+		if err := validateIdentifier("column", newName); err != nil {
+			return err
+		}
+	}
+	for _, name := range c.DropColumns {
+		if err := validateIdentifier("column", name); err != nil {
+			return err
+		}
+	}
+	for name, column := range c.Columns {
+		if err := validateIdentifier("column", name); err != nil {
+			return err
+		}
+		if column.Type == "" && column.Codec == "" {
+			return fmt.Errorf("column %s overrides neither type nor codec", name)
+		}
+	}
+	if len(c.LabelColumns) > 0 && !c.LabelsMap {
+		return fmt.Errorf("label-columns require labels-map")
+	}
+	if c.LabelsMap && c.Dedup == DedupReplacing {
+		// Rows are only replaced if all labels are in the sort key, which the labels map can't be
+		return fmt.Errorf("labels-map can't be combined with dedup strategy %s", DedupReplacing)
+	}
+	if c.Mode != "" && !slices.Contains(Modes, c.Mode) {
+		return fmt.Errorf("unknown mode %s, expected one of %v", c.Mode, Modes)
+	}
+	if len(c.Queries) == 0 {
+		return fmt.Errorf("no queries defined")
+	}
+	names := []string{}
+	for _, q := range c.Queries {
+		if q.Name == "" {
+			return fmt.Errorf("query without name")
+		}
+		if slices.Contains(names, q.Name) {
+			return fmt.Errorf("query %s is defined more than once", q.Name)
+		}
+		names = append(names, q.Name)
+		if err := validateIdentifier("query", q.Name); err != nil {
+			return err
+		}
+		if q.PromQL == "" {
+			return fmt.Errorf("query %s has no promql", q.Name)
+		}
+		if q.Value == "" {
+			return fmt.Errorf("query %s has no value", q.Name)
+		}
+		if err := validateIdentifier("value", q.Value); err != nil {
+			return err
+		}
+		if err := validateDurations(q.Step, q.Timeout, q.InitialLookback, q.Offset); err != nil {
+			return fmt.Errorf("query %s: %w", q.Name, err)
+		}
+		if err := c.validatePoints(q); err != nil {
+			return fmt.Errorf("query %s: %w", q.Name, err)
+		}
+		if q.Mode != "" && !slices.Contains(Modes, q.Mode) {
+			return fmt.Errorf("query %s has unknown mode %s, expected one of %v", q.Name, q.Mode, Modes)
+		}
+		if q.Aggregation != "" && !slices.Contains(Aggregations, strings.ToUpper(q.Aggregation)) {
+			return fmt.Errorf("query %s has unknown aggregation %s, expected one of %v", q.Name, q.Aggregation, Aggregations)
+		}
+	}
+	if c.ReplaceSnapshot && !slices.ContainsFunc(c.Queries, func(q Query) bool { return c.GetMode(q) == ModeInstant }) {
+		return fmt.Errorf("replace-snapshot requires instant queries")
+	}
+	return nil
+}
+
+// validateDurations rejects negative query durations.
+func validateDurations(step, timeout, initialLookback, offset time.Duration) error {
+	if step < 0 {
+		return fmt.Errorf("negative step %s", step)
+	}
+	if timeout < 0 {
+		return fmt.Errorf("negative timeout %s", timeout)
+	}
+	if initialLookback < 0 {
+		return fmt.Errorf("negative initial-lookback %s", initialLookback)
+	}
+	if offset < 0 {
+		return fmt.Errorf("negative offset %s", offset)
+	}
+	return nil
+}
+
+// validatePoints checks that the step of a range query doesn't skip scrapes
+// and that its regular and initial sync windows stay within MaxSyncPoints.
+// Windows exceeding the points per series of a Prometheus query are split, see SplitPoints.
+func (c *Cube) validatePoints(query Query) error {
+	if c.GetMode(query) != ModeRange {
+		return nil
+	}
+	step := c.GetStep(query)
+	scrapeInterval := c.GetScrapeInterval()
+	if step > scrapeInterval {
+		return fmt.Errorf("step %s exceeds scrape-interval %s", step, scrapeInterval)
+	}
+	maxWindow := step * (MaxSyncPoints - 1)
+	if scrapeInterval > maxWindow {
+		return fmt.Errorf("scrape-interval %s exceeds %d points per series at step %s", scrapeInterval, MaxSyncPoints, step)
+	}
+	if lookback := c.GetInitialLookback(query); lookback > maxWindow {
+		return fmt.Errorf("initial-lookback %s exceeds %d points per series at step %s, use backfill for longer ranges", lookback, MaxSyncPoints, step)
+	}
+	return nil
+}
+
+// GetScrapeInterval returns how often the cube is synced, DefaultScrapeInterval by default.
+func (c *Cube) GetScrapeInterval() time.Duration {
+	return firstPositive(c.ScrapeInterval, DefaultScrapeInterval)
+}
+
+// GetStep returns the range query resolution of a query of the cube, DefaultStep by default.
+// The zero Query returns the step of the cube.
+func (c *Cube) GetStep(query Query) time.Duration {
+	return firstPositive(query.Step, c.Step, DefaultStep)
+}
+
+// GetTimeout returns the evaluation timeout of a query of the cube, DefaultTimeout by default.
+func (c *Cube) GetTimeout(query Query) time.Duration {
+	return firstPositive(query.Timeout, c.Timeout, DefaultTimeout)
+}
+
+// GetInitialLookback returns the range of a query synced when there is no
+// sync state yet, DefaultRange by default. The zero Query returns the one of the cube.
+func (c *Cube) GetInitialLookback(query Query) time.Duration {
+	return firstPositive(query.InitialLookback, c.InitialLookback, DefaultRange)
+}
+
+// GetOffset returns how long before now the sync window of the cube ends.
+// Queries are joined on the same window, so the largest offset of the cube and its queries applies.
+func (c *Cube) GetOffset() time.Duration {
+	offset := c.Offset
+	for _, q := range c.Queries {
+		offset = max(offset, q.Offset)
+	}
+	return offset
+}
+
+// minStep returns the smallest step of the cube's queries.
+func (c *Cube) minStep() time.Duration {
+	step := c.GetStep(Query{})
+	for _, q := range c.Queries {
+		step = min(step, c.GetStep(q))
+	}
+	return step
+}
+
+func firstPositive(durations ...time.Duration) time.Duration {
+	for _, d := range durations {
+		if d > 0 {
+			return d
+		}
+	}
+	return 0
 }
 
 func (c *Cube) GetMetricColumns() []string {
@@ -34,6 +305,22 @@ func (c *Cube) GetMetricColumns() []string {
 	return cols
 }
 
+// GetJoinStrategy returns the join strategy of the cube, JoinRollup by default.
+func (c *Cube) GetJoinStrategy() string {
+	if c.JoinStrategy == "" {
+		return JoinRollup
+	}
+	return c.JoinStrategy
+}
+
+// GetJoinMode returns the join mode of the cube, JoinModeMemory by default.
+func (c *Cube) GetJoinMode() string {
+	if c.JoinMode == "" {
+		return JoinModeMemory
+	}
+	return c.JoinMode
+}
+
 func (c *Cube) GetAggregation(query string) string {
 	for _, q := range c.Queries {
 		if q.Name == query {
@@ -0,0 +1,207 @@
+package platon
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+)
+
+// DiscoveryConfig configures how metrics and their labels are discovered.
+type DiscoveryConfig struct {
+	// Window is how far back series are considered.
+	Window time.Duration
+	// BatchSize is the number of metrics whose series are requested at once.
+	BatchSize int
+	// CacheDir holds the discovery results for CacheTTL. A CacheTTL of zero disables the cache.
+	CacheDir string
+	CacheTTL time.Duration
+}
+
+// DefaultDiscoveryConfig returns the discovery settings used by the CLI unless overridden.
+func DefaultDiscoveryConfig() DiscoveryConfig {
+	cacheDir := ""
+	if userCacheDir, err := os.UserCacheDir(); err == nil {
+		cacheDir = filepath.Join(userCacheDir, "platon")
+	}
+	return DiscoveryConfig{
+		Window:    DefaultRange,
+		BatchSize: 100,
+		CacheDir:  cacheDir,
+		CacheTTL:  10 * time.Minute,
+	}
+}
+
+// discoveryCache is the file format of cached discovery results.
+type discoveryCache struct {
+	FetchedAt time.Time       `json:"fetched_at"`
+	Result    json.RawMessage `json:"result"`
+}
+
+// GetMetrics returns the metrics with series in the discovery window and
+// their label names, or only the metrics in metricsFilter. Label names are
+// read from the series API, requesting the series of BatchSize metrics at once.
+func (p *Platon) GetMetrics(ctx context.Context, metricsFilter ...string) ([]Metric, error) {
+	metrics := []Metric{}
+	if p.readDiscoveryCache("metrics", metricsFilter, &metrics) {
+		return metrics, nil
+	}
+
+	v1api := v1.NewAPI(p.Client)
+	start, end := p.discoveryWindow()
+	names := slices.Clone(metricsFilter)
+	if len(names) == 0 {
+		values, warnings, err := v1api.LabelValues(ctx, model.MetricNameLabel, []string{}, start, end)
+		// Always log the warnings even if errors cause crash
+		if len(warnings) > 0 {
+			fmt.Printf("Warnings: %v\n", warnings)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list metric names: %w", err)
+		}
+		for _, value := range values {
+			names = append(names, string(value))
+		}
+	}
+
+	dimensions := map[string][]string{}
+	for batch := range slices.Chunk(names, max(p.Discovery.BatchSize, 1)) {
+		series, warnings, err := v1api.Series(ctx, []string{metricNameMatcher(batch)}, start, end)
+		if len(warnings) > 0 {
+			fmt.Printf("Warnings: %v\n", warnings)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to query series of metrics %s: %w", strings.Join(batch, ", "), err)
+		}
+		for _, labels := range series {
+			name := string(labels[model.MetricNameLabel])
+			for label := range labels {
+				if label == model.MetricNameLabel || slices.Contains(dimensions[name], string(label)) {
+					continue
+				}
+				dimensions[name] = append(dimensions[name], string(label))
+			}
+		}
+	}
+
+	for _, name := range names {
+		if _, ok := dimensions[name]; !ok {
+			// No series in the discovery window
+			continue
+		}
+		slices.Sort(dimensions[name])
+		metrics = append(metrics, Metric{Name: name, Dimensions: dimensions[name]})
+	}
+	p.writeDiscoveryCache("metrics", metricsFilter, metrics)
+	return metrics, nil
+}
+
+// GetLabelNames returns the label names of all series in the discovery window,
+// or only of the series of the metrics in metricsFilter, using the labels API.
+func (p *Platon) GetLabelNames(ctx context.Context, metricsFilter ...string) ([]string, error) {
+	labels := []string{}
+	if p.readDiscoveryCache("labels", metricsFilter, &labels) {
+		return labels, nil
+	}
+
+	v1api := v1.NewAPI(p.Client)
+	start, end := p.discoveryWindow()
+	matchers := [][]string{{}}
+	if len(metricsFilter) > 0 {
+		matchers = [][]string{}
+		for batch := range slices.Chunk(metricsFilter, max(p.Discovery.BatchSize, 1)) {
+			matchers = append(matchers, []string{metricNameMatcher(batch)})
+		}
+	}
+	for _, matcher := range matchers {
+		names, warnings, err := v1api.LabelNames(ctx, matcher, start, end)
+		if len(warnings) > 0 {
+			fmt.Printf("Warnings: %v\n", warnings)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list label names: %w", err)
+		}
+		labels = append(labels, names...)
+	}
+	labels = slices.DeleteFunc(labels, func(label string) bool { return label == model.MetricNameLabel })
+	slices.Sort(labels)
+	labels = slices.Compact(labels)
+	p.writeDiscoveryCache("labels", metricsFilter, labels)
+	return labels, nil
+}
+
+// metricNameMatcher returns a series selector matching all given metric names.
+func metricNameMatcher(names []string) string {
+	quoted := []string{}
+	for _, name := range names {
+		quoted = append(quoted, regexp.QuoteMeta(name))
+	}
+	return fmt.Sprintf("{%s=~%q}", model.MetricNameLabel, strings.Join(quoted, "|"))
+}
+
+func (p *Platon) discoveryWindow() (time.Time, time.Time) {
+	end := time.Now()
+	window := p.Discovery.Window
+	if window <= 0 {
+		window = DefaultRange
+	}
+	return end.Add(-window), end
+}
+
+// discoveryCacheFile returns the cache file of a discovery result. It is
+// specific to the Prometheus server, the window and the metrics filter.
+func (p *Platon) discoveryCacheFile(kind string, metricsFilter []string) string {
+	filter := slices.Clone(metricsFilter)
+	slices.Sort(filter)
+	hash := sha256.Sum256([]byte(strings.Join(append([]string{p.Prometheus.URL, p.Discovery.Window.String()}, filter...), "\x00")))
+	return filepath.Join(p.Discovery.CacheDir, fmt.Sprintf("%s-%s.json", kind, hex.EncodeToString(hash[:])[:16]))
+}
+
+// readDiscoveryCache reads a cached discovery result into result if it is younger than CacheTTL.
+func (p *Platon) readDiscoveryCache(kind string, metricsFilter []string, result any) bool {
+	if p.Discovery.CacheTTL <= 0 || p.Discovery.CacheDir == "" {
+		return false
+	}
+	content, err := os.ReadFile(p.discoveryCacheFile(kind, metricsFilter))
+	if err != nil {
+		return false
+	}
+	cache := discoveryCache{}
+	if err := json.Unmarshal(content, &cache); err != nil {
+		return false
+	}
+	if time.Since(cache.FetchedAt) > p.Discovery.CacheTTL {
+		return false
+	}
+	return json.Unmarshal(cache.Result, result) == nil
+}
+
+// writeDiscoveryCache caches a discovery result. Failing to write the cache only prints a warning.
+func (p *Platon) writeDiscoveryCache(kind string, metricsFilter []string, result any) {
+	if p.Discovery.CacheTTL <= 0 || p.Discovery.CacheDir == "" {
+		return
+	}
+	content, err := json.Marshal(result)
+	if err == nil {
+		content, err = json.Marshal(discoveryCache{FetchedAt: time.Now(), Result: content})
+	}
+	if err == nil {
+		err = os.MkdirAll(p.Discovery.CacheDir, 0755)
+	}
+	if err == nil {
+		err = os.WriteFile(p.discoveryCacheFile(kind, metricsFilter), content, 0644)
+	}
+	if err != nil {
+		fmt.Printf("Failed to cache discovered %s: %v\n", kind, err)
+	}
+}
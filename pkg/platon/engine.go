@@ -0,0 +1,347 @@
+package platon
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultEngine      = "MergeTree"
+	DefaultPartitionBy = "toYYYYMMDD(Time)"
+	DefaultBatchSize   = 10000
+
+	// DedupNone appends every sync, duplicating rows of overlapping syncs.
+	DedupNone = "none"
+	// DedupReplacing creates ReplacingMergeTree tables, keeping the row of the latest sync.
+	DedupReplacing = "replacing"
+	// DedupToken drops inserts of a part of a sync window which has been
+	// inserted before. Sync windows end on scrape interval boundaries, so a
+	// failed sync which is repeated inserts the same parts.
+	DedupToken = "token"
+	// DedupDelete deletes the sync window before inserting it.
+	DedupDelete = "delete"
+
+	// VersionColumn holds the insert time of a row in ReplacingMergeTree tables.
+	VersionColumn = "Version"
+
+	deduplicationWindow        = 1000
+	deduplicationWindowSetting = "non_replicated_deduplication_window"
+)
+
+var DedupStrategies = []string{DedupNone, DedupReplacing, DedupToken, DedupDelete}
+
+// TableOptions configure the table engine of a cube or query table and how data is inserted.
+type TableOptions struct {
+	Engine      string
+	OrderBy     []string
+	PartitionBy string
+	Ttl         time.Duration
+	BatchSize   int
+	AsyncInsert bool
+	Dedup       string
+	// NullableDimensions makes dimensions outside the sort key Nullable, see JoinNull.
+	NullableDimensions bool
+	// NullableMetrics makes metrics Nullable, for tables with rows missing a metric.
+	NullableMetrics bool
+	// Timezone of the Time column and Columns overriding the type and codec of columns, see Cube.
+	Timezone string
+	Columns  map[string]ColumnConfig
+	// LabelsMap stores all dimensions except LabelColumns in the LabelsColumn map.
+	LabelsMap    bool
+	LabelColumns []string
+	// ReplaceSnapshot deletes all rows older than the inserted sync window, see ModeInstant.
+	ReplaceSnapshot bool
+	// DedupInterval is the length of the parts of a sync window inserted with
+	// their own deduplication token, see insertBatches.
+	DedupInterval time.Duration
+	// Cube and CubeVersion identify the cube in the schema history, see ApplyMigrations.
+	Cube          string
+	CubeVersion   string
+	ColumnRenames map[string]string
+	DropColumns   []string
+}
+
+// tableOptions returns the engine settings of a table belonging to the cube.
+// Unless overridden, tables are daily partitioned MergeTrees sorted by the
+// joined labels and Time, expiring after the cube's TTL.
+func (c *Cube) tableOptions(table Table) TableOptions {
+	options := TableOptions{
+		Engine:      c.Engine,
+		OrderBy:     c.OrderBy,
+		PartitionBy: c.PartitionBy,
+		Ttl:         c.Ttl,
+		BatchSize:   c.BatchSize,
+		AsyncInsert: c.AsyncInsert,
+		Dedup:       c.Dedup,
+		// Only the joined cube table can have NULL dimensions
+		NullableDimensions: table.Name == c.Name && c.GetJoinStrategy() == JoinNull,
+		// Rows of the joined table lack the metrics of queries they weren't joined with
+		NullableMetrics: table.Name == c.Name && len(c.Queries) > 1,
+		Timezone:        c.Timezone,
+		Columns:         c.Columns,
+		LabelsMap:       c.LabelsMap,
+		LabelColumns:    c.labelColumns(table),
+		ReplaceSnapshot: c.ReplaceSnapshot && c.snapshotTable(table),
+		DedupInterval:   c.GetScrapeInterval(),
+		Cube:            c.Name,
+		CubeVersion:     c.version(),
+		ColumnRenames:   c.ColumnRenames,
+		DropColumns:     c.DropColumns,
+	}
+	if options.Dedup == "" {
+		options.Dedup = DedupNone
+	}
+	if options.Engine == "" {
+		options.Engine = DefaultEngine
+		if options.Dedup == DedupReplacing {
+			options.Engine = fmt.Sprintf("ReplacingMergeTree(%s)", VersionColumn)
+		}
+	}
+	if len(options.OrderBy) == 0 {
+		options.OrderBy = []string{}
+		for _, label := range c.JoinedLabels {
+			if slices.Contains(table.Dimensions, label) {
+				options.OrderBy = append(options.OrderBy, label)
+			}
+		}
+		if options.Dedup == DedupReplacing {
+			// Rows are only replaced if all dimensions are equal
+			for _, d := range table.Dimensions {
+				if !slices.Contains(options.OrderBy, d) {
+					options.OrderBy = append(options.OrderBy, d)
+				}
+			}
+		}
+		options.OrderBy = append(options.OrderBy, "Time")
+	}
+	if options.PartitionBy == "" {
+		options.PartitionBy = DefaultPartitionBy
+	}
+	return options
+}
+
+// labelColumns returns the dimensions of the table which are stored as
+// columns with LabelsMap: the joined labels and the cube's LabelColumns,
+// which are prefixed with the query name in the joined table.
+func (c *Cube) labelColumns(table Table) []string {
+	columns := []string{}
+	for _, d := range table.Dimensions {
+		promoted := slices.Contains(c.JoinedLabels, d) || slices.Contains(c.LabelColumns, d)
+		if table.Name == c.Name {
+			for _, q := range c.Queries {
+				label, found := strings.CutPrefix(d, q.Name+"_")
+				promoted = promoted || found && slices.Contains(c.LabelColumns, label)
+			}
+		}
+		if promoted {
+			columns = append(columns, d)
+		}
+	}
+	return columns
+}
+
+// engineClause returns the ENGINE, PARTITION BY, ORDER BY and TTL clauses of CREATE TABLE.
+// Sort key entries naming a column are quoted, all others are expressions.
+func (t Table) engineClause() string {
+	o := t.Options
+	engine := o.Engine
+	if engine == "" {
+		engine = DefaultEngine
+	}
+	clause := "ENGINE = " + engine
+	if o.PartitionBy != "" {
+		clause += " PARTITION BY " + o.PartitionBy
+	}
+	if len(o.OrderBy) > 0 {
+		columns := t.GetColumns()
+		orderBy := []string{}
+		for _, entry := range o.OrderBy {
+			if slices.ContainsFunc(columns, func(c Column) bool { return c.Name == entry }) {
+				entry = quoteIdentifier(entry)
+			}
+			orderBy = append(orderBy, entry)
+		}
+		clause += " ORDER BY (" + strings.Join(orderBy, ", ") + ")"
+	}
+	if ttl := o.ttlExpression(); ttl != "" {
+		clause += " TTL " + ttl
+	}
+	if o.Dedup == DedupToken {
+		clause += " SETTINGS " + deduplicationSetting()
+	}
+	return clause
+}
+
+// deleteWindow deletes the rows of the table's sync window, so re-inserting it doesn't duplicate rows.
+func (p *Platon) deleteWindow(ctx context.Context, table Table) error {
+	sql := fmt.Sprintf("DELETE FROM %s WHERE Time >= ? AND Time <= ?", quoteIdentifier(table.Name))
+	err := p.exec(ctx, sql, table.Start.UTC(), table.End.UTC())
+	if err != nil {
+		return fmt.Errorf("failed to delete sync window of table %s: %w", table.Name, err)
+	}
+	return nil
+}
+
+// insertBatch holds the rows of a single INSERT and its deduplication token.
+type insertBatch struct {
+	Rows  []*Row
+	Token string
+}
+
+// insertBatches splits the rows of the table into batches of at most
+// batchSize rows. With DedupToken, the rows are first split into parts of
+// DedupInterval ending on multiples of it. The token of a batch is derived
+// from the time range of its part within the sync window, so a complete part
+// has the same tokens in every sync window containing it.
+func (t Table) insertBatches(batchSize int) []insertBatch {
+	if t.Options.Dedup != DedupToken {
+		batches := []insertBatch{}
+		for rows := range slices.Chunk(t.Rows, batchSize) {
+			batches = append(batches, insertBatch{Rows: rows})
+		}
+		return batches
+	}
+
+	interval := t.Options.DedupInterval
+	parts := map[time.Time][]*Row{}
+	partEnds := []time.Time{}
+	for _, r := range t.Rows {
+		// Parts include their end, like the range of a sync window. Without
+		// an interval, the whole window is a single part.
+		partEnd := t.End
+		if interval > 0 {
+			partEnd = r.Time.Truncate(interval)
+			if partEnd.Before(r.Time) {
+				partEnd = partEnd.Add(interval)
+			}
+		}
+		if _, ok := parts[partEnd]; !ok {
+			partEnds = append(partEnds, partEnd)
+		}
+		parts[partEnd] = append(parts[partEnd], r)
+	}
+	slices.SortFunc(partEnds, func(a, b time.Time) int { return a.Compare(b) })
+
+	batches := []insertBatch{}
+	for _, partEnd := range partEnds {
+		from, to := t.Start, t.End
+		if interval > 0 && partEnd.Add(-interval).After(from) {
+			from = partEnd.Add(-interval)
+		}
+		if interval > 0 && (to.IsZero() || partEnd.Before(to)) {
+			to = partEnd
+		}
+		for offset := 0; offset < len(parts[partEnd]); offset += batchSize {
+			batches = append(batches, insertBatch{
+				Rows:  parts[partEnd][offset:min(offset+batchSize, len(parts[partEnd]))],
+				Token: fmt.Sprintf("%s/%d-%d/%d", t.Name, from.UnixMilli(), to.UnixMilli(), offset),
+			})
+		}
+	}
+	return batches
+}
+
+// deduplicationSetting returns the setting enabling insert deduplication of DedupToken tables.
+func deduplicationSetting() string {
+	return fmt.Sprintf("%s = %d", deduplicationWindowSetting, deduplicationWindow)
+}
+
+// EnsureEngine checks that an existing table switched to DedupReplacing
+// after it has been created is a ReplacingMergeTree. The engine of a table
+// can't be altered, so the table has to be recreated.
+func (p *Platon) EnsureEngine(ctx context.Context, table Table) error {
+	if table.Options.Dedup != DedupReplacing {
+		return nil
+	}
+	engine, err := p.tableEngine(ctx, table.Name)
+	if err != nil {
+		return err
+	}
+	// Also matches the replicated and shared variants of the engine
+	name, _, _ := strings.Cut(engine, "(")
+	if strings.HasSuffix(strings.TrimSpace(name), "ReplacingMergeTree") {
+		return nil
+	}
+	return fmt.Errorf("existing table %s has engine %s, rows of overlapping syncs wouldn't be replaced; recreate the table or choose another dedup strategy", table.Name, strings.TrimSpace(name))
+}
+
+// EnsureDeduplicationWindow enables insert deduplication of an existing
+// table switched to DedupToken after it has been created.
+func (p *Platon) EnsureDeduplicationWindow(ctx context.Context, table Table) error {
+	if table.Options.Dedup != DedupToken {
+		return nil
+	}
+	engine, err := p.tableEngine(ctx, table.Name)
+	if err != nil {
+		return err
+	}
+	if strings.Contains(engine, deduplicationSetting()) {
+		return nil
+	}
+	sql := fmt.Sprintf("ALTER TABLE %s MODIFY SETTING %s", quoteIdentifier(table.Name), deduplicationSetting())
+	err = p.exec(ctx, sql)
+	if err != nil {
+		return fmt.Errorf("failed to enable insert deduplication of table %s: %w", table.Name, err)
+	}
+	return nil
+}
+
+// ttlExpression returns the TTL expression in the form ClickHouse normalizes it
+// to, so it can be compared with the one of an existing table.
+func (o TableOptions) ttlExpression() string {
+	if o.Ttl <= 0 {
+		return ""
+	}
+	return fmt.Sprintf("Time + toIntervalSecond(%d)", int64(o.Ttl.Seconds()))
+}
+
+// tableEngine returns the engine of an existing table including all its clauses.
+func (p *Platon) tableEngine(ctx context.Context, name string) (string, error) {
+	sql := "SELECT engine_full FROM system.tables WHERE database = currentDatabase() AND name = ?"
+	row := p.Database.Connection.QueryRow(ctx, sql, name)
+	var engineFull string
+	if err := row.Scan(&engineFull); err != nil {
+		return "", fmt.Errorf("failed to query engine of table %s: %w", name, err)
+	}
+	return engineFull, nil
+}
+
+// tableTtl returns the TTL expression of an existing table, or an empty string if it has none.
+func (p *Platon) tableTtl(ctx context.Context, name string) (string, error) {
+	engineFull, err := p.tableEngine(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	_, ttl, found := strings.Cut(engineFull, " TTL ")
+	if !found {
+		return "", nil
+	}
+	ttl, _, _ = strings.Cut(ttl, " SETTINGS ")
+	return strings.TrimSpace(ttl), nil
+}
+
+// EnsureTtl alters the TTL of an existing table if it differs from the configured one.
+func (p *Platon) EnsureTtl(ctx context.Context, table Table) error {
+	existing, err := p.tableTtl(ctx, table.Name)
+	if err != nil {
+		return err
+	}
+	expected := table.Options.ttlExpression()
+	if existing == expected {
+		return nil
+	}
+	fmt.Printf("TTL of table %s changed from '%s' to '%s'.\n", table.Name, existing, expected)
+
+	sql := fmt.Sprintf("ALTER TABLE %s MODIFY TTL %s", quoteIdentifier(table.Name), expected)
+	if expected == "" {
+		sql = fmt.Sprintf("ALTER TABLE %s REMOVE TTL", quoteIdentifier(table.Name))
+	}
+	err = p.exec(ctx, sql)
+	if err != nil {
+		return fmt.Errorf("failed to update TTL of table %s: %w", table.Name, err)
+	}
+	return nil
+}
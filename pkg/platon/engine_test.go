@@ -0,0 +1,159 @@
+package platon
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+)
+
+// formatInsertBatches returns the token and row offsets of every batch.
+func formatInsertBatches(batches []insertBatch) []string {
+	formatted := []string{}
+	for _, batch := range batches {
+		offsets := []time.Duration{}
+		for _, r := range batch.Rows {
+			offsets = append(offsets, r.Time.Sub(joinTestTime))
+		}
+		formatted = append(formatted, fmt.Sprintf("%s %v", batch.Token, offsets))
+	}
+	return formatted
+}
+
+func TestInsertBatches(t *testing.T) {
+	token := func(from, to time.Duration, offset int) string {
+		return fmt.Sprintf("cpu/%d-%d/%d", joinTestTime.Add(from).UnixMilli(), joinTestTime.Add(to).UnixMilli(), offset)
+	}
+
+	tests := []struct {
+		name      string
+		dedup     string
+		interval  time.Duration
+		start     time.Duration
+		end       time.Duration
+		rows      []time.Duration
+		batchSize int
+		expected  []string
+	}{
+		{
+			name:      "no token",
+			dedup:     DedupNone,
+			interval:  time.Minute,
+			end:       2 * time.Minute,
+			rows:      []time.Duration{0, 30 * time.Second, time.Minute, 90 * time.Second, 2 * time.Minute},
+			batchSize: 2,
+			expected:  []string{" [0s 30s]", " [1m0s 1m30s]", " [2m0s]"},
+		},
+		{
+			name:      "interval",
+			dedup:     DedupToken,
+			interval:  time.Minute,
+			end:       2 * time.Minute,
+			rows:      []time.Duration{0, 30 * time.Second, time.Minute, 90 * time.Second, 2 * time.Minute},
+			batchSize: 10,
+			expected: []string{
+				token(0, 0, 0) + " [0s]",
+				token(0, time.Minute, 0) + " [30s 1m0s]",
+				token(time.Minute, 2*time.Minute, 0) + " [1m30s 2m0s]",
+			},
+		},
+		{
+			name:      "batches of a part",
+			dedup:     DedupToken,
+			interval:  time.Minute,
+			start:     10 * time.Second,
+			end:       time.Minute,
+			rows:      []time.Duration{10 * time.Second, 20 * time.Second, 30 * time.Second, time.Minute},
+			batchSize: 2,
+			expected: []string{
+				token(10*time.Second, time.Minute, 0) + " [10s 20s]",
+				token(10*time.Second, time.Minute, 2) + " [30s 1m0s]",
+			},
+		},
+		{
+			name:      "no interval",
+			dedup:     DedupToken,
+			end:       2 * time.Minute,
+			rows:      []time.Duration{0, 30 * time.Second, time.Minute, 90 * time.Second, 2 * time.Minute},
+			batchSize: 3,
+			expected: []string{
+				token(0, 2*time.Minute, 0) + " [0s 30s 1m0s]",
+				token(0, 2*time.Minute, 3) + " [1m30s 2m0s]",
+			},
+		},
+		{
+			name:      "window starting and ending mid-part",
+			dedup:     DedupToken,
+			interval:  time.Minute,
+			start:     30 * time.Second,
+			end:       150 * time.Second,
+			rows:      []time.Duration{30 * time.Second, time.Minute, 90 * time.Second, 2 * time.Minute, 150 * time.Second},
+			batchSize: 10,
+			expected: []string{
+				token(30*time.Second, time.Minute, 0) + " [30s 1m0s]",
+				token(time.Minute, 2*time.Minute, 0) + " [1m30s 2m0s]",
+				token(2*time.Minute, 150*time.Second, 0) + " [2m30s]",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			table := Table{
+				Name:    "cpu",
+				Start:   joinTestTime.Add(test.start),
+				End:     joinTestTime.Add(test.end),
+				Options: TableOptions{Dedup: test.dedup, DedupInterval: test.interval},
+			}
+			for _, offset := range test.rows {
+				table.InsertRow(joinTestRow(offset, nil, nil))
+			}
+			if batches := formatInsertBatches(table.insertBatches(test.batchSize)); !slices.Equal(batches, test.expected) {
+				t.Errorf("expected batches\n%q\ngot\n%q", test.expected, batches)
+			}
+		})
+	}
+}
+
+func TestInsertBatchesOverlappingWindows(t *testing.T) {
+	window := func(start, end time.Duration) map[string][]time.Duration {
+		table := Table{
+			Name:    "cpu",
+			Start:   joinTestTime.Add(start),
+			End:     joinTestTime.Add(end),
+			Options: TableOptions{Dedup: DedupToken, DedupInterval: time.Minute},
+		}
+		for offset := start; offset <= end; offset += 15 * time.Second {
+			table.InsertRow(joinTestRow(offset, nil, nil))
+		}
+		tokens := map[string][]time.Duration{}
+		for _, batch := range table.insertBatches(DefaultBatchSize) {
+			for _, r := range batch.Rows {
+				tokens[batch.Token] = append(tokens[batch.Token], r.Time.Sub(joinTestTime))
+			}
+		}
+		return tokens
+	}
+
+	// The failed sync of 0s to 3m is repeated up to 4m, another window overlaps it from 1m30s to 3m30s
+	first, retry, overlapping := window(0, 3*time.Minute), window(0, 4*time.Minute), window(90*time.Second, 210*time.Second)
+	for _, part := range []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute} {
+		tokens := []string{}
+		for token, rows := range first {
+			if rows[len(rows)-1] == part {
+				tokens = append(tokens, token)
+			}
+		}
+		if len(tokens) != 1 {
+			t.Fatalf("expected a single token of the part ending at %s, got %q", part, tokens)
+		}
+		if !slices.Equal(retry[tokens[0]], first[tokens[0]]) {
+			t.Errorf("expected the part ending at %s to have the same token and rows in the repeated sync, got %v", part, retry[tokens[0]])
+		}
+		// Only complete parts of the overlapping window have the same token
+		shared := part == 3*time.Minute
+		if _, found := overlapping[tokens[0]]; found != shared {
+			t.Errorf("expected the token of the part ending at %s to be shared with the overlapping window=%t, got %t", part, shared, found)
+		}
+	}
+}
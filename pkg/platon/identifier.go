@@ -0,0 +1,38 @@
+package platon
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// identifierPattern matches the cube, query, metric and label names accepted
+// in cube files: Prometheus metric names, including recording rules like
+// job:rate5m, and dashes as used in cube names.
+var identifierPattern = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:\-]*$`)
+
+// identifierEscaper escapes the characters which would end a backtick quoted identifier.
+var identifierEscaper = strings.NewReplacer("\\", "\\\\", "`", "\\`")
+
+// quoteIdentifier returns a table or column name quoted for use in ClickHouse SQL.
+// All names must be quoted with it, since label names come from Prometheus.
+func quoteIdentifier(name string) string {
+	return "`" + identifierEscaper.Replace(name) + "`"
+}
+
+// quoteIdentifiers quotes each name with quoteIdentifier.
+func quoteIdentifiers(names []string) []string {
+	quoted := make([]string, 0, len(names))
+	for _, name := range names {
+		quoted = append(quoted, quoteIdentifier(name))
+	}
+	return quoted
+}
+
+// validateIdentifier rejects names which aren't valid identifiers in cube files.
+func validateIdentifier(kind, name string) error {
+	if !identifierPattern.MatchString(name) {
+		return fmt.Errorf("invalid %s name %q, expected letters, digits, '_', ':' and '-' not starting with a digit or '-'", kind, name)
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package platon
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestQuoteIdentifier(t *testing.T) {
+	tests := []struct {
+		name, quoted string
+	}{
+		{"cpu", "`cpu`"},
+		{"job:rate5m", "`job:rate5m`"},
+		{"my-cube", "`my-cube`"},
+		{"", "``"},
+		{"a`b", "`a\\`b`"},
+		{"a\\b", "`a\\\\b`"},
+		{"a\\`; DROP TABLE t; --", "`a\\\\\\`; DROP TABLE t; --`"},
+		{"läbel with space", "`läbel with space`"},
+	}
+	for _, test := range tests {
+		if quoted := quoteIdentifier(test.name); quoted != test.quoted {
+			t.Errorf("expected %q to be quoted as %s, got %s", test.name, test.quoted, quoted)
+		}
+	}
+
+	if quoted, expected := quoteIdentifiers([]string{"Time", "a`b"}), []string{"`Time`", "`a\\`b`"}; !slices.Equal(quoted, expected) {
+		t.Errorf("expected quoted identifiers %v, got %v", expected, quoted)
+	}
+}
+
+func TestValidateIdentifier(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"cpu", true},
+		{"node_memory_MemFree_bytes", true},
+		{"job:rate5m", true},
+		{":rate", true},
+		{"_private", true},
+		{"my-cube", true},
+		{"pod2", true},
+		{"", false},
+		{"2pods", false},
+		{"-cube", false},
+		{"a`b", false},
+		{"a\\b", false},
+		{"a b", false},
+		{"a.b", false},
+		{"läbel", false},
+		{"cpu\n", false},
+	}
+	for _, test := range tests {
+		if err := validateIdentifier("label", test.name); (err == nil) != test.valid {
+			t.Errorf("expected %q to be valid=%t, got error %v", test.name, test.valid, err)
+		}
+	}
+}
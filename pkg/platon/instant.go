@@ -0,0 +1,94 @@
+package platon
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+)
+
+const (
+	// ModeRange queries every step of the sync window with the range query API.
+	ModeRange = "range"
+	// ModeInstant queries a snapshot at the end of the sync window with the instant query API.
+	ModeInstant = "instant"
+)
+
+var Modes = []string{ModeRange, ModeInstant}
+
+// GetMode returns the mode of a query of the cube. Queries default to the
+// mode of the cube, which defaults to ModeRange.
+func (c *Cube) GetMode(query Query) string {
+	if query.Mode != "" {
+		return query.Mode
+	}
+	if c.Mode != "" {
+		return c.Mode
+	}
+	return ModeRange
+}
+
+// instantOnly reports whether all queries of the cube are instant queries.
+func (c *Cube) instantOnly() bool {
+	for _, q := range c.Queries {
+		if c.GetMode(q) != ModeInstant {
+			return false
+		}
+	}
+	return true
+}
+
+// snapshotTable reports whether the table only holds instant query results,
+// which is the case for tables of instant queries and the joined table of
+// cubes with only instant queries.
+func (c *Cube) snapshotTable(table Table) bool {
+	if table.Name == c.Name {
+		return c.instantOnly()
+	}
+	for _, q := range c.Queries {
+		if q.Name == table.Name {
+			return c.GetMode(q) == ModeInstant
+		}
+	}
+	return false
+}
+
+// querySamples runs a query of the cube for the sync window between start and
+// end. Instant queries are evaluated at end, so their rows are stamped with the scrape time.
+func (p *Platon) querySamples(ctx context.Context, cube Cube, query Query, start, end time.Time) (model.Value, error) {
+	if cube.GetMode(query) == ModeInstant {
+		return p.GetInstantSamples(ctx, query.PromQL, end, cube.GetTimeout(query))
+	}
+	return p.GetSamples(ctx, query.PromQL, start, end, cube.GetStep(query), cube.GetTimeout(query))
+}
+
+func (p *Platon) GetInstantSamples(ctx context.Context, metric string, ts time.Time, timeout time.Duration) (model.Value, error) {
+	v1api := v1.NewAPI(p.Client)
+
+	result, warnings, err := v1api.Query(ctx, metric, ts, v1.WithTimeout(timeout))
+	// Always log the warnings even if errors cause crash
+	if len(warnings) > 0 {
+		fmt.Printf("Warnings: %v\n", warnings)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error querying Prometheus: %w", err)
+	}
+
+	return result, nil
+}
+
+// replaceSnapshot deletes the rows of previous snapshots from a table with
+// TableOptions.ReplaceSnapshot, keeping only the rows of the sync window's end.
+func (p *Platon) replaceSnapshot(ctx context.Context, table Table) error {
+	if !table.Options.ReplaceSnapshot || table.End.IsZero() {
+		return nil
+	}
+	sql := fmt.Sprintf("DELETE FROM %s WHERE Time < ?", quoteIdentifier(table.Name))
+	err := p.exec(ctx, sql, table.End.Truncate(time.Millisecond).UTC())
+	if err != nil {
+		return fmt.Errorf("failed to delete previous snapshot of table %s: %w", table.Name, err)
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package platon
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	// JoinRollup marks dimensions of ambiguous joins with AmbiguityMarker.
+	JoinRollup = "rollup"
+	// JoinExplode joins ambiguous rows as Cartesian product.
+	JoinExplode = "explode"
+	// JoinNull marks dimensions of ambiguous joins with NULL.
+	JoinNull = "null"
+	// JoinAggregate aggregates the right table to the join key before joining.
+	JoinAggregate = "aggregate"
+)
+
+var JoinStrategies = []string{JoinRollup, JoinExplode, JoinNull, JoinAggregate}
+
+// Aggregations are the supported query aggregations.
+var Aggregations = []string{"SUM", "AVG", "MIN", "MAX", "COUNT"}
+
+// joinIndex groups rows by their join key, the values of the joined labels
+// and Time, so matching rows are found without scanning the whole table.
+type joinIndex struct {
+	labels []string
+	rows   map[string][]*Row
+}
+
+func newJoinIndex(labels []string, rows []*Row) joinIndex {
+	index := joinIndex{
+		labels: labels,
+		rows:   make(map[string][]*Row, len(rows)),
+	}
+	for _, r := range rows {
+		key := index.key(r)
+		index.rows[key] = append(index.rows[key], r)
+	}
+	return index
+}
+
+// key returns the join key of a row. A missing label has the same key as an
+// empty label value, like in PromQL.
+func (i joinIndex) key(r *Row) string {
+	key := strings.Builder{}
+	key.WriteString(strconv.FormatInt(r.Time.UnixNano(), 10))
+	for _, label := range i.labels {
+		key.WriteByte(0)
+		key.WriteString(r.Dimensions[label])
+	}
+	return key.String()
+}
+
+// mergeInto copies the dimensions and metrics of the table's row r into target.
+func (t Table) mergeInto(cube Cube, target, r *Row) {
+	for d, v := range r.Dimensions {
+		target.Dimensions[t.joinedDimension(cube, d)] = v
+	}
+	for m, v := range r.Metrics {
+		target.Metrics[m] = v
+	}
+}
+
+// setAmbiguous marks a dimension of a row which can't be joined unambiguously.
+func setAmbiguous(strategy string, r *Row, dimension string) {
+	if strategy == JoinNull {
+		delete(r.Dimensions, dimension)
+		return
+	}
+	r.Dimensions[dimension] = AmbiguityMarker
+}
+
+// aggregateToJoinKey returns a copy of the table with a single row per join
+// key. Metrics are aggregated with the aggregation of the table's query,
+// dimensions which are not joined labels are dropped.
+func (t Table) aggregateToJoinKey(cube Cube) (Table, error) {
+	aggregated := Table{
+		Name:       t.Name,
+		Dimensions: []string{},
+		Metrics:    t.Metrics,
+		Rows:       []*Row{},
+		Options:    t.Options,
+	}
+	for _, d := range t.Dimensions {
+		if slices.Contains(cube.JoinedLabels, d) {
+			aggregated.Dimensions = append(aggregated.Dimensions, d)
+		}
+	}
+	aggregation := strings.ToUpper(cube.GetAggregation(t.Name))
+
+	index := newJoinIndex(cube.JoinedLabels, t.Rows)
+	seen := map[string]bool{}
+	for _, r := range t.Rows {
+		key := index.key(r)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		matches := index.rows[key]
+		row := NewRow(r.Time)
+		for _, d := range aggregated.Dimensions {
+			if v, ok := r.Dimensions[d]; ok {
+				row.Dimensions[d] = v
+			}
+		}
+		for _, m := range t.Metrics {
+			values := []float64{}
+			for _, match := range matches {
+				if v, ok := match.Metrics[m]; ok {
+					values = append(values, v)
+				}
+			}
+			if len(values) == 0 {
+				continue
+			}
+			value, err := aggregate(aggregation, values)
+			if err != nil {
+				return Table{}, fmt.Errorf("failed to aggregate %s of table %s: %w", m, t.Name, err)
+			}
+			row.Metrics[m] = value
+		}
+		aggregated.InsertRow(row)
+	}
+	return aggregated, nil
+}
+
+func aggregate(aggregation string, values []float64) (float64, error) {
+	switch aggregation {
+	case "SUM", "":
+		sum := 0.0
+		for _, v := range values {
+			sum += v
+		}
+		return sum, nil
+	case "AVG":
+		sum, _ := aggregate("SUM", values)
+		return sum / float64(len(values)), nil
+	case "MIN":
+		return slices.Min(values), nil
+	case "MAX":
+		return slices.Max(values), nil
+	case "COUNT":
+		return float64(len(values)), nil
+	}
+	return 0, fmt.Errorf("unknown aggregation %s, expected one of %v", aggregation, Aggregations)
+}
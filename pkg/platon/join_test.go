@@ -0,0 +1,281 @@
+package platon
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+var joinTestTime = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+func joinTestRow(offset time.Duration, dimensions map[string]string, metrics map[string]float64) *Row {
+	row := NewRow(joinTestTime.Add(offset))
+	for d, v := range dimensions {
+		row.Dimensions[d] = v
+	}
+	for m, v := range metrics {
+		row.Metrics[m] = v
+	}
+	return row
+}
+
+func joinTestTables(left, right []*Row) (Table, Table) {
+	return Table{Name: "cpu", Dimensions: []string{"namespace", "pod"}, Metrics: []string{"cpu"}, Rows: left},
+		Table{Name: "mem", Dimensions: []string{"namespace", "container"}, Metrics: []string{"mem"}, Rows: right}
+}
+
+func TestPlatonLeftJoin(t *testing.T) {
+	cube := Cube{Name: "cube", JoinedLabels: []string{"namespace"}}
+
+	tests := []struct {
+		name     string
+		left     []*Row
+		right    []*Row
+		expected []*Row
+	}{
+		{
+			name: "one-to-one",
+			left: []*Row{
+				joinTestRow(0, map[string]string{"namespace": "a", "pod": "p1"}, map[string]float64{"cpu": 1}),
+			},
+			right: []*Row{
+				joinTestRow(0, map[string]string{"namespace": "a", "container": "c1"}, map[string]float64{"mem": 2}),
+			},
+			expected: []*Row{
+				joinTestRow(0, map[string]string{"namespace": "a", "pod": "p1", "mem_container": "c1"}, map[string]float64{"cpu": 1, "mem": 2}),
+			},
+		},
+		{
+			name: "one-to-many",
+			left: []*Row{
+				joinTestRow(0, map[string]string{"namespace": "a", "pod": "p1"}, map[string]float64{"cpu": 1}),
+			},
+			right: []*Row{
+				joinTestRow(0, map[string]string{"namespace": "a", "container": "c1"}, map[string]float64{"mem": 2}),
+				joinTestRow(0, map[string]string{"namespace": "a", "container": "c2"}, map[string]float64{"mem": 3}),
+			},
+			expected: []*Row{
+				joinTestRow(0, map[string]string{"namespace": "a", "pod": "p1", "mem_container": AmbiguityMarker}, map[string]float64{"cpu": 1}),
+				joinTestRow(0, map[string]string{"namespace": "a", "pod": AmbiguityMarker, "mem_container": "c1"}, map[string]float64{"mem": 2}),
+				joinTestRow(0, map[string]string{"namespace": "a", "pod": AmbiguityMarker, "mem_container": "c2"}, map[string]float64{"mem": 3}),
+			},
+		},
+		{
+			name: "many-to-one",
+			left: []*Row{
+				joinTestRow(0, map[string]string{"namespace": "a", "pod": "p1"}, map[string]float64{"cpu": 1}),
+				joinTestRow(0, map[string]string{"namespace": "a", "pod": "p2"}, map[string]float64{"cpu": 2}),
+			},
+			right: []*Row{
+				joinTestRow(0, map[string]string{"namespace": "a", "container": "c1"}, map[string]float64{"mem": 3}),
+			},
+			expected: []*Row{
+				joinTestRow(0, map[string]string{"namespace": "a", "pod": "p1", "mem_container": AmbiguityMarker}, map[string]float64{"cpu": 1}),
+				joinTestRow(0, map[string]string{"namespace": "a", "pod": "p2", "mem_container": AmbiguityMarker}, map[string]float64{"cpu": 2}),
+				joinTestRow(0, map[string]string{"namespace": "a", "pod": AmbiguityMarker, "mem_container": "c1"}, map[string]float64{"mem": 3}),
+			},
+		},
+		{
+			name: "many-to-many",
+			left: []*Row{
+				joinTestRow(0, map[string]string{"namespace": "a", "pod": "p1"}, map[string]float64{"cpu": 1}),
+				joinTestRow(0, map[string]string{"namespace": "a", "pod": "p2"}, map[string]float64{"cpu": 2}),
+			},
+			right: []*Row{
+				joinTestRow(0, map[string]string{"namespace": "a", "container": "c1"}, map[string]float64{"mem": 3}),
+				joinTestRow(0, map[string]string{"namespace": "a", "container": "c2"}, map[string]float64{"mem": 4}),
+			},
+			expected: []*Row{
+				joinTestRow(0, map[string]string{"namespace": "a", "pod": "p1", "mem_container": AmbiguityMarker}, map[string]float64{"cpu": 1}),
+				joinTestRow(0, map[string]string{"namespace": "a", "pod": "p2", "mem_container": AmbiguityMarker}, map[string]float64{"cpu": 2}),
+				joinTestRow(0, map[string]string{"namespace": "a", "pod": AmbiguityMarker, "mem_container": "c1"}, map[string]float64{"mem": 3}),
+				joinTestRow(0, map[string]string{"namespace": "a", "pod": AmbiguityMarker, "mem_container": "c2"}, map[string]float64{"mem": 4}),
+			},
+		},
+		{
+			name: "right-only",
+			left: []*Row{
+				joinTestRow(0, map[string]string{"namespace": "a", "pod": "p1"}, map[string]float64{"cpu": 1}),
+			},
+			right: []*Row{
+				joinTestRow(0, map[string]string{"namespace": "b", "container": "c1"}, map[string]float64{"mem": 2}),
+			},
+			expected: []*Row{
+				joinTestRow(0, map[string]string{"namespace": "a", "pod": "p1"}, map[string]float64{"cpu": 1}),
+				joinTestRow(0, map[string]string{"namespace": "b", "mem_container": "c1"}, map[string]float64{"mem": 2}),
+			},
+		},
+		{
+			name: "left-only",
+			left: []*Row{
+				joinTestRow(0, map[string]string{"namespace": "a", "pod": "p1"}, map[string]float64{"cpu": 1}),
+				joinTestRow(0, map[string]string{"namespace": "b", "pod": "p2"}, map[string]float64{"cpu": 2}),
+			},
+			right: []*Row{
+				joinTestRow(0, map[string]string{"namespace": "a", "container": "c1"}, map[string]float64{"mem": 3}),
+			},
+			expected: []*Row{
+				joinTestRow(0, map[string]string{"namespace": "a", "pod": "p1", "mem_container": "c1"}, map[string]float64{"cpu": 1, "mem": 3}),
+				joinTestRow(0, map[string]string{"namespace": "b", "pod": "p2"}, map[string]float64{"cpu": 2}),
+			},
+		},
+		{
+			name: "different timestamps",
+			left: []*Row{
+				joinTestRow(0, map[string]string{"namespace": "a", "pod": "p1"}, map[string]float64{"cpu": 1}),
+			},
+			right: []*Row{
+				joinTestRow(time.Minute, map[string]string{"namespace": "a", "container": "c1"}, map[string]float64{"mem": 2}),
+			},
+			expected: []*Row{
+				joinTestRow(0, map[string]string{"namespace": "a", "pod": "p1"}, map[string]float64{"cpu": 1}),
+				joinTestRow(time.Minute, map[string]string{"namespace": "a", "mem_container": "c1"}, map[string]float64{"mem": 2}),
+			},
+		},
+		{
+			name: "missing joined labels",
+			left: []*Row{
+				joinTestRow(0, map[string]string{"pod": "p1"}, map[string]float64{"cpu": 1}),
+				joinTestRow(0, map[string]string{"namespace": "a", "pod": "p2"}, map[string]float64{"cpu": 2}),
+			},
+			right: []*Row{
+				joinTestRow(0, map[string]string{"namespace": "", "container": "c1"}, map[string]float64{"mem": 3}),
+				joinTestRow(0, map[string]string{"container": "c2"}, map[string]float64{"mem": 4}),
+			},
+			expected: []*Row{
+				joinTestRow(0, map[string]string{"pod": "p1", "mem_container": AmbiguityMarker}, map[string]float64{"cpu": 1}),
+				joinTestRow(0, map[string]string{"namespace": "a", "pod": "p2"}, map[string]float64{"cpu": 2}),
+				joinTestRow(0, map[string]string{"namespace": "", "pod": AmbiguityMarker, "mem_container": "c1"}, map[string]float64{"mem": 3}),
+				joinTestRow(0, map[string]string{"pod": AmbiguityMarker, "mem_container": "c2"}, map[string]float64{"mem": 4}),
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			left, right := joinTestTables(test.left, test.right)
+			joined, err := left.platonLeftJoin(cube, right)
+			if err != nil {
+				t.Fatalf("join failed: %v", err)
+			}
+			if dimensions := []string{"namespace", "pod", "mem_container"}; !slices.Equal(joined.Dimensions, dimensions) {
+				t.Errorf("expected dimensions %v, got %v", dimensions, joined.Dimensions)
+			}
+			if metrics := []string{"cpu", "mem"}; !slices.Equal(joined.Metrics, metrics) {
+				t.Errorf("expected metrics %v, got %v", metrics, joined.Metrics)
+			}
+			if !reflect.DeepEqual(joined.Rows, test.expected) {
+				t.Errorf("expected rows\n%s\ngot\n%s", formatJoinTestRows(test.expected), formatJoinTestRows(joined.Rows))
+			}
+		})
+	}
+}
+
+func formatJoinTestRows(rows []*Row) string {
+	formatted := ""
+	for _, r := range rows {
+		formatted += fmt.Sprintf("  %s %v %v\n", r.Time.Format(time.TimeOnly), r.Dimensions, r.Metrics)
+	}
+	return formatted
+}
+
+// BenchmarkPlatonLeftJoin joins three query tables of 10k series with 60
+// samples each. In the one-to-one case every series matches one series of the
+// other tables, in the many-to-many case 100 series of every table share a
+// join key.
+func BenchmarkPlatonLeftJoin(b *testing.B) {
+	const (
+		series     = 10000
+		timestamps = 60
+	)
+	queries := []struct {
+		name  string
+		label string
+	}{{"cpu", "core"}, {"mem", "container"}, {"net", "interface"}}
+
+	newTables := func() []Table {
+		tables := []Table{}
+		for q, query := range queries {
+			table := Table{Name: query.name, Dimensions: []string{"namespace", "pod", query.label}, Metrics: []string{query.name}}
+			for i := range series {
+				for ts := range timestamps {
+					table.InsertRow(joinTestRow(time.Duration(ts)*time.Minute, map[string]string{
+						"namespace": fmt.Sprintf("ns-%d", i%100),
+						"pod":       fmt.Sprintf("pod-%d", i),
+						query.label: fmt.Sprintf("%s-%d", query.label, i),
+					}, map[string]float64{query.name: float64((q + 1) * i)}))
+				}
+			}
+			tables = append(tables, table)
+		}
+		return tables
+	}
+
+	join := func(b *testing.B, cube Cube, verify func(b *testing.B, joined Table)) {
+		p := &Platon{}
+		for n := 0; n < b.N; n++ {
+			b.StopTimer()
+			tables := newTables()
+			b.StartTimer()
+
+			joined, err := p.generateFullTable(cube, tables)
+			if err != nil {
+				b.Fatalf("join failed: %v", err)
+			}
+
+			b.StopTimer()
+			verify(b, joined)
+			b.StartTimer()
+		}
+	}
+
+	b.Run("one-to-one", func(b *testing.B) {
+		cube := Cube{Name: "cube", JoinedLabels: []string{"namespace", "pod"}}
+		join(b, cube, func(b *testing.B, joined Table) {
+			if len(joined.Rows) != series*timestamps {
+				b.Fatalf("expected %d joined rows, got %d", series*timestamps, len(joined.Rows))
+			}
+			for _, r := range joined.Rows {
+				var i int
+				if _, err := fmt.Sscanf(r.Dimensions["pod"], "pod-%d", &i); err != nil {
+					b.Fatalf("unexpected pod of joined row %v", r.Dimensions)
+				}
+				expected := map[string]float64{"cpu": float64(i), "mem": float64(2 * i), "net": float64(3 * i)}
+				if !reflect.DeepEqual(r.Metrics, expected) {
+					b.Fatalf("expected metrics %v of pod-%d, got %v", expected, i, r.Metrics)
+				}
+				for _, d := range []string{"mem_container", "net_interface"} {
+					if strings.Contains(r.Dimensions[d], AmbiguityMarker) || !strings.HasSuffix(r.Dimensions[d], fmt.Sprintf("-%d", i)) {
+						b.Fatalf("unexpected %s of joined row %v", d, r.Dimensions)
+					}
+				}
+			}
+		})
+	})
+
+	b.Run("many-to-many", func(b *testing.B) {
+		cube := Cube{Name: "cube", JoinedLabels: []string{"namespace"}}
+		join(b, cube, func(b *testing.B, joined Table) {
+			// Every row keeps its own metric and is ambiguous for the dimensions of the tables joined after it
+			if len(joined.Rows) != len(queries)*series*timestamps {
+				b.Fatalf("expected %d joined rows, got %d", len(queries)*series*timestamps, len(joined.Rows))
+			}
+			for _, r := range joined.Rows {
+				if len(r.Metrics) != 1 {
+					b.Fatalf("expected a single metric of joined row, got %v", r.Metrics)
+				}
+				joinedAfter := false
+				for _, query := range queries {
+					if joinedAfter && r.Dimensions[query.name+"_"+query.label] != AmbiguityMarker {
+						b.Fatalf("expected %s_%s of joined row %v to be ambiguous", query.name, query.label, r.Dimensions)
+					}
+					_, found := r.Metrics[query.name]
+					joinedAfter = joinedAfter || found
+				}
+			}
+		})
+	})
+}
@@ -0,0 +1,358 @@
+package platon
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	SchemaHistoryTable = "platon_schema_history"
+
+	MigrationCreate = "create"
+	MigrationAdd    = "add"
+	MigrationModify = "modify"
+	MigrationDrop   = "drop"
+	MigrationRename = "rename"
+)
+
+// Migration is a single schema change of a cube or query table.
+type Migration struct {
+	Operation string
+	Column    Column
+	// NewName is the column name after a rename.
+	NewName string
+	// FromType and FromCodec are the type and codec of the existing column of a modify.
+	FromType  string
+	FromCodec string
+}
+
+// Destructive reports whether the migration can lose data. Drops delete the
+// column's data and type changes which aren't lossless may fail or truncate values.
+func (m Migration) Destructive() bool {
+	switch m.Operation {
+	case MigrationDrop:
+		return true
+	case MigrationModify:
+		return !losslessTypeChange(m.FromType, m.Column.DataType)
+	}
+	return false
+}
+
+// Statement returns the ALTER TABLE statement applying the migration to table.
+func (m Migration) Statement(table string) string {
+	switch m.Operation {
+	case MigrationAdd:
+		return fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s", quoteIdentifier(table), m.Column.Definition())
+	case MigrationModify:
+		if m.Column.Codec == "" && m.FromCodec != "" && m.FromType == m.Column.DataType {
+			return fmt.Sprintf("ALTER TABLE %s MODIFY COLUMN %s REMOVE CODEC", quoteIdentifier(table), quoteIdentifier(m.Column.Name))
+		}
+		return fmt.Sprintf("ALTER TABLE %s MODIFY COLUMN %s", quoteIdentifier(table), m.Column.Definition())
+	case MigrationDrop:
+		return fmt.Sprintf("ALTER TABLE %s DROP COLUMN %s", quoteIdentifier(table), quoteIdentifier(m.Column.Name))
+	case MigrationRename:
+		return fmt.Sprintf("ALTER TABLE %s RENAME COLUMN %s TO %s", quoteIdentifier(table), quoteIdentifier(m.Column.Name), quoteIdentifier(m.NewName))
+	}
+	return ""
+}
+
+func (m Migration) String() string {
+	switch m.Operation {
+	case MigrationAdd:
+		return fmt.Sprintf("+ %s %s", m.Column.Name, m.Column.DataType)
+	case MigrationModify:
+		return fmt.Sprintf("~ %s %s -> %s", m.Column.Name, typeWithCodec(m.FromType, m.FromCodec), typeWithCodec(m.Column.DataType, m.Column.Codec))
+	case MigrationDrop:
+		return fmt.Sprintf("- %s %s", m.Column.Name, m.Column.DataType)
+	case MigrationRename:
+		return fmt.Sprintf("> %s -> %s", m.Column.Name, m.NewName)
+	}
+	return m.Operation
+}
+
+// PlanMigrations returns the changes turning the existing columns of a table
+// into the expected ones. Renames map old to new column names; a rename is
+// only planned if the old column exists and the new one doesn't yet, so it is
+// applied once. Renames come first, followed by adds, type and codec changes and drops.
+//
+// Existing columns which aren't expected are kept, as the expected columns
+// only contain the labels of the synced data. Only the columns listed in
+// drops are dropped, unless they are expected again.
+//
+// ClickHouse only allows adding or removing LowCardinality to the type of
+// keyColumns, the columns of the sort, primary and partition key. Other type
+// changes of key columns aren't planned, they require recreating the table.
+// Key columns are never dropped.
+func PlanMigrations(existing, expected []Column, keyColumns []string, renames map[string]string, drops []string) []Migration {
+	migrations := []Migration{}
+	current := slices.Clone(existing)
+	indexOf := func(columns []Column, name string) int {
+		return slices.IndexFunc(columns, func(c Column) bool { return c.Name == name })
+	}
+
+	oldNames := []string{}
+	for oldName := range renames {
+		oldNames = append(oldNames, oldName)
+	}
+	slices.Sort(oldNames)
+	for _, oldName := range oldNames {
+		newName := renames[oldName]
+		i := indexOf(current, oldName)
+		if i < 0 || indexOf(current, newName) >= 0 || indexOf(expected, newName) < 0 {
+			continue
+		}
+		migrations = append(migrations, Migration{Operation: MigrationRename, Column: current[i], NewName: newName})
+		current[i].Name = newName
+	}
+
+	for _, e := range expected {
+		i := indexOf(current, e.Name)
+		if i < 0 {
+			migrations = append(migrations, Migration{Operation: MigrationAdd, Column: e})
+			continue
+		}
+		if slices.Contains(keyColumns, e.Name) && removeLowCardinality(current[i].DataType) != removeLowCardinality(e.DataType) {
+			e.DataType = current[i].DataType
+		}
+		if current[i].DataType != e.DataType || !codecsEqual(current[i].Codec, e.Codec) {
+			migrations = append(migrations, Migration{Operation: MigrationModify, Column: e, FromType: current[i].DataType, FromCodec: current[i].Codec})
+		}
+	}
+	for _, c := range current {
+		if slices.Contains(drops, c.Name) && indexOf(expected, c.Name) < 0 && !slices.Contains(keyColumns, c.Name) {
+			migrations = append(migrations, Migration{Operation: MigrationDrop, Column: c})
+		}
+	}
+	return migrations
+}
+
+func typeWithCodec(dataType, codec string) string {
+	if codec == "" {
+		return dataType
+	}
+	return fmt.Sprintf("%s CODEC(%s)", dataType, codec)
+}
+
+// codecsEqual compares the codec of an existing column with a configured one.
+// ClickHouse adds the default level to codecs configured without one, e.g.
+// ZSTD becomes ZSTD(1), so these only have to match the codec name.
+func codecsEqual(existing, expected string) bool {
+	existingCodecs := splitCodecs(existing)
+	expectedCodecs := splitCodecs(expected)
+	if len(existingCodecs) != len(expectedCodecs) {
+		return false
+	}
+	for i, codec := range expectedCodecs {
+		if !strings.Contains(codec, "(") {
+			existingCodecs[i], _, _ = strings.Cut(existingCodecs[i], "(")
+		}
+		if !strings.EqualFold(existingCodecs[i], codec) {
+			return false
+		}
+	}
+	return true
+}
+
+// splitCodecs splits a codec list like "CODEC(Delta(4), ZSTD(1))" into its codecs.
+func splitCodecs(codec string) []string {
+	codec = strings.ReplaceAll(codec, " ", "")
+	if inner, found := strings.CutPrefix(codec, "CODEC("); found {
+		codec = strings.TrimSuffix(inner, ")")
+	}
+	codecs := []string{}
+	depth, start := 0, 0
+	for i, c := range codec {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				codecs = append(codecs, codec[start:i])
+				start = i + 1
+			}
+		}
+	}
+	if start < len(codec) {
+		codecs = append(codecs, codec[start:])
+	}
+	return codecs
+}
+
+var dateTimeType = regexp.MustCompile(`^DateTime(64)?(\((\d+)?.*\))?$`)
+
+// losslessTypeChange reports whether all values of a column can be converted
+// from one type to the other without losing data. That is the case for adding
+// or removing LowCardinality, adding Nullable, widening Float32 to Float64 and
+// increasing the precision or changing the timezone of DateTime columns.
+func losslessTypeChange(from, to string) bool {
+	fromType, fromNullable := unwrapType(from)
+	toType, toNullable := unwrapType(to)
+	if fromNullable && !toNullable {
+		return false
+	}
+	if fromType == toType || fromType == "Float32" && toType == "Float64" {
+		return true
+	}
+	fromTime := dateTimeType.FindStringSubmatch(fromType)
+	toTime := dateTimeType.FindStringSubmatch(toType)
+	if fromTime == nil || toTime == nil {
+		return false
+	}
+	// DateTime has a precision of seconds, DateTime64 defaults to milliseconds
+	precision := func(match []string) int {
+		if match[1] == "" {
+			return 0
+		}
+		if p, err := strconv.Atoi(match[3]); err == nil {
+			return p
+		}
+		return 3
+	}
+	return precision(toTime) >= precision(fromTime)
+}
+
+func removeLowCardinality(dataType string) string {
+	if inner, found := strings.CutPrefix(dataType, "LowCardinality("); found {
+		return strings.TrimSuffix(inner, ")")
+	}
+	return dataType
+}
+
+var keyIdentifier = regexp.MustCompile("`([^`]+)`|[a-zA-Z_][a-zA-Z0-9_]*")
+
+// tableKeyColumns returns the names used in the sort, primary and partition key of an existing table.
+func (p *Platon) tableKeyColumns(ctx context.Context, name string) ([]string, error) {
+	sql := "SELECT sorting_key, primary_key, partition_key FROM system.tables WHERE database = currentDatabase() AND name = ?"
+	row := p.Database.Connection.QueryRow(ctx, sql, name)
+	var sortingKey, primaryKey, partitionKey string
+	if err := row.Scan(&sortingKey, &primaryKey, &partitionKey); err != nil {
+		return nil, fmt.Errorf("failed to query keys of table %s: %w", name, err)
+	}
+	columns := []string{}
+	for _, match := range keyIdentifier.FindAllStringSubmatch(strings.Join([]string{sortingKey, primaryKey, partitionKey}, ","), -1) {
+		column := match[0]
+		if match[1] != "" {
+			column = match[1]
+		}
+		if !slices.Contains(columns, column) {
+			columns = append(columns, column)
+		}
+	}
+	return columns, nil
+}
+
+// unwrapType removes the LowCardinality and Nullable modifiers of a type and
+// reports whether it is Nullable.
+func unwrapType(dataType string) (string, bool) {
+	nullable := false
+	for {
+		if inner, found := strings.CutPrefix(dataType, "LowCardinality("); found {
+			dataType = strings.TrimSuffix(inner, ")")
+			continue
+		}
+		if inner, found := strings.CutPrefix(dataType, "Nullable("); found {
+			dataType = strings.TrimSuffix(inner, ")")
+			nullable = true
+			continue
+		}
+		return dataType, nullable
+	}
+}
+
+// ApplyMigrations plans and applies the migrations of an existing table.
+// Destructive migrations are skipped with a warning unless AllowDestructive is set.
+func (p *Platon) ApplyMigrations(ctx context.Context, table Table) error {
+	existing, err := p.DescribeTable(ctx, table.Name)
+	if err != nil {
+		return err
+	}
+	keyColumns, err := p.tableKeyColumns(ctx, table.Name)
+	if err != nil {
+		return err
+	}
+	migrations := PlanMigrations(existing, table.GetColumns(), keyColumns, table.Options.ColumnRenames, table.Options.DropColumns)
+	if len(migrations) == 0 {
+		return nil
+	}
+
+	fmt.Printf("Schema migrations of table %s:\n", table.Name)
+	for _, m := range migrations {
+		fmt.Printf("  %s\n", m)
+	}
+	for _, m := range migrations {
+		// The sort key of an existing table can't be extended by a new label, so
+		// ReplacingMergeTree would merge rows which only differ in the label.
+		if m.Operation == MigrationAdd && table.Options.Dedup == DedupReplacing && slices.Contains(table.Options.OrderBy, m.Column.Name) {
+			return fmt.Errorf("new column %s of table %s isn't part of the sort key of the existing table, rows differing only in %s would be replaced; recreate the table or choose another dedup strategy", m.Column.Name, table.Name, m.Column.Name)
+		}
+	}
+	for _, m := range migrations {
+		if m.Destructive() && !p.AllowDestructive {
+			fmt.Printf("Skipping destructive migration '%s' of table %s, enable it with --allow-destructive.\n", m, table.Name)
+			continue
+		}
+		sql := m.Statement(table.Name)
+		err := p.exec(ctx, sql)
+		if err != nil {
+			return fmt.Errorf("failed to migrate table %s with SQL '%s': %w", table.Name, sql, err)
+		}
+		err = p.recordMigration(ctx, table, m.Operation, sql)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EnsureSchemaHistoryTable creates the table recording every schema change applied to cube tables.
+func (p *Platon) EnsureSchemaHistoryTable(ctx context.Context) error {
+	sql := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	Cube String,
+	CubeVersion String,
+	Table String,
+	Operation String,
+	Statement String,
+	AppliedAt DateTime64(3)
+) ENGINE = MergeTree ORDER BY (Cube, AppliedAt)`, quoteIdentifier(SchemaHistoryTable))
+
+	err := p.exec(ctx, sql)
+	if err != nil {
+		return fmt.Errorf("failed to create schema history table: %w", err)
+	}
+	return nil
+}
+
+// recordMigration stores an applied schema change in the schema history.
+func (p *Platon) recordMigration(ctx context.Context, table Table, operation, statement string) error {
+	sql := fmt.Sprintf("INSERT INTO %s (Cube, CubeVersion, Table, Operation, Statement, AppliedAt) VALUES (?, ?, ?, ?, ?, ?)", quoteIdentifier(SchemaHistoryTable))
+	err := p.exec(ctx, sql, table.Options.Cube, table.Options.CubeVersion, table.Name, operation, statement, time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("failed to record schema migration of table %s: %w", table.Name, err)
+	}
+	return nil
+}
+
+// version identifies the cube configuration in the schema history. Unless
+// set explicitly, it is derived from a hash of the configuration.
+func (c *Cube) version() string {
+	if c.Version != "" {
+		return c.Version
+	}
+	config, err := yaml.Marshal(c)
+	if err != nil {
+		return ""
+	}
+	hash := sha256.Sum256(config)
+	return hex.EncodeToString(hash[:])[:12]
+}
@@ -0,0 +1,134 @@
+package platon
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestPlanMigrations(t *testing.T) {
+	existing := []Column{
+		{Name: "Time", DataType: "DateTime64(3)"},
+		{Name: "ns", DataType: "LowCardinality(String)"},
+		{Name: "pod", DataType: "LowCardinality(String)"},
+		{Name: "v", DataType: "Float64"},
+	}
+	keyColumns := []string{"ns", "Time"}
+
+	tests := []struct {
+		name     string
+		expected []Column
+		renames  map[string]string
+		drops    []string
+		planned  []string
+	}{
+		{
+			name:     "unchanged",
+			expected: existing,
+			planned:  []string{},
+		},
+		{
+			name:     "empty window",
+			expected: []Column{{Name: "Time", DataType: "DateTime64(3)"}},
+			planned:  []string{},
+		},
+		{
+			name: "sparse label",
+			expected: []Column{
+				{Name: "Time", DataType: "DateTime64(3)"},
+				{Name: "ns", DataType: "LowCardinality(String)"},
+				{Name: "container", DataType: "LowCardinality(String)"},
+				{Name: "v", DataType: "Float64"},
+			},
+			planned: []string{"+ container LowCardinality(String)"},
+		},
+		{
+			name: "rename",
+			expected: []Column{
+				{Name: "Time", DataType: "DateTime64(3)"},
+				{Name: "ns", DataType: "LowCardinality(String)"},
+				{Name: "pod_name", DataType: "LowCardinality(String)"},
+				{Name: "v", DataType: "Float64"},
+			},
+			renames: map[string]string{"pod": "pod_name", "missing": "other"},
+			planned: []string{"> pod -> pod_name"},
+		},
+		{
+			name:     "drop",
+			expected: []Column{{Name: "Time", DataType: "DateTime64(3)"}, {Name: "v", DataType: "Float64"}},
+			drops:    []string{"pod", "v"},
+			planned:  []string{"- pod LowCardinality(String)"},
+		},
+		{
+			name: "key column",
+			expected: []Column{
+				{Name: "Time", DataType: "DateTime64(6)"},
+				{Name: "ns", DataType: "String"},
+				{Name: "pod", DataType: "String"},
+			},
+			drops:   []string{"ns"},
+			planned: []string{"~ ns LowCardinality(String) -> String", "~ pod LowCardinality(String) -> String"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			planned := []string{}
+			for _, m := range PlanMigrations(existing, test.expected, keyColumns, test.renames, test.drops) {
+				planned = append(planned, m.String())
+			}
+			if !slices.Equal(planned, test.planned) {
+				t.Errorf("expected migrations %q, got %q", test.planned, planned)
+			}
+		})
+	}
+}
+
+func TestLosslessTypeChange(t *testing.T) {
+	tests := []struct {
+		from, to string
+		lossless bool
+	}{
+		{"String", "String", true},
+		{"String", "LowCardinality(String)", true},
+		{"LowCardinality(String)", "String", true},
+		{"String", "LowCardinality(Nullable(String))", true},
+		{"LowCardinality(Nullable(String))", "LowCardinality(String)", false},
+		{"Float64", "Nullable(Float64)", true},
+		{"Nullable(Float64)", "Float64", false},
+		{"Float32", "Float64", true},
+		{"Float64", "Float32", false},
+		{"DateTime", "DateTime64(3)", true},
+		{"DateTime('UTC')", "DateTime64(3, 'Europe/Berlin')", true},
+		{"DateTime64(3)", "DateTime64(6)", true},
+		{"DateTime64(3)", "DateTime", false},
+		{"String", "Map(String, String)", false},
+		{"Float64", "String", false},
+	}
+	for _, test := range tests {
+		if lossless := losslessTypeChange(test.from, test.to); lossless != test.lossless {
+			t.Errorf("expected change from %s to %s to be lossless=%t, got %t", test.from, test.to, test.lossless, lossless)
+		}
+	}
+}
+
+func TestCodecsEqual(t *testing.T) {
+	tests := []struct {
+		existing, expected string
+		equal              bool
+	}{
+		{"", "", true},
+		{"CODEC(Delta(8), ZSTD(1))", "Delta, ZSTD", true},
+		{"Delta(8), ZSTD(1)", "Delta(8), ZSTD(1)", true},
+		{"Delta(8), ZSTD(1)", "delta(8),zstd(1)", true},
+		{"ZSTD(1)", "ZSTD(3)", false},
+		{"Delta(8), ZSTD(1)", "ZSTD", false},
+		{"ZSTD(1)", "", false},
+		{"", "ZSTD", false},
+		{"Gorilla", "Delta", false},
+	}
+	for _, test := range tests {
+		if equal := codecsEqual(test.existing, test.expected); equal != test.equal {
+			t.Errorf("expected codecs %q and %q to be equal=%t, got %t", test.existing, test.expected, test.equal, equal)
+		}
+	}
+}
@@ -2,17 +2,14 @@ package platon
 
 import (
 	"context"
-	"crypto/tls"
 	"fmt"
 	"log"
-	"net/http"
 	"os"
 	"slices"
-	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	sb "github.com/huandu/go-sqlbuilder"
 	"github.com/jedib0t/go-pretty/v6/table"
 	"github.com/platolytics/platon-mk3/pkg/db/clickhouse"
 	"github.com/prometheus/client_golang/api"
@@ -21,63 +18,99 @@ import (
 )
 
 type Platon struct {
-	Cubes         Cubes
-	Database      clickhouse.Clickhouse
-	StartTime     time.Time
-	EndTime       time.Time
-	Client        api.Client
-	PrometheusUrl string
-	ctx           context.Context
+	Cubes      Cubes
+	Database   clickhouse.Clickhouse
+	Client     api.Client
+	Prometheus PrometheusConfig
+	Discovery  DiscoveryConfig
+	Options
+	// views holds the last applied definition of each cube view, see ensureView.
+	views   map[string]string
+	viewsMu sync.Mutex
+}
+
+// Options control how Platon modifies ClickHouse.
+type Options struct {
+	// DryRun queries Prometheus and reads from ClickHouse, but only prints
+	// the statements and inserts which would modify ClickHouse.
+	DryRun bool
+	// AllowDestructive applies schema migrations which can lose data, see Migration.Destructive.
+	AllowDestructive bool
 }
 
 type Metric struct {
-	Name       string
-	Dimensions []string
+	Name       string   `json:"name"`
+	Dimensions []string `json:"dimensions"`
 }
 
+// DefaultRange is the initial lookback of cubes without a sync state.
 var DefaultRange time.Duration = 1 * time.Hour
 
+// AmbiguityMarker replaces dimension values which can't be joined unambiguously.
+const AmbiguityMarker = "*"
+
+// DefaultStep is the resolution of Prometheus range queries.
+var DefaultStep time.Duration = 1 * time.Minute
+
+// DefaultTimeout is the evaluation timeout of Prometheus queries.
+var DefaultTimeout time.Duration = 30 * time.Second
+
 // Change DefaultRange for quick iteration during development
 //var DefaultRange time.Duration = 5 * time.Minute
 
-func WatchCubes(clickhouse clickhouse.Clickhouse, cubes Cubes, prometheusUrl string) {
-	p := NewPlaton(prometheusUrl)
+// WatchCubes syncs all cubes on their scrape interval, updating at most workers cubes at the same time.
+// Cubes received on reloads replace the running configuration. It returns once
+// ctx is cancelled and all running updates have finished.
+func WatchCubes(ctx context.Context, clickhouse clickhouse.Clickhouse, cubes Cubes, prometheus PrometheusConfig, options Options, workers int, reloads <-chan Cubes) {
+	p := NewPlaton(prometheus)
 	p.Cubes = cubes
 	p.Database = clickhouse
+	p.Options = options
+
+	err := p.EnsureSyncStateTable(ctx)
+	if err != nil {
+		panic(err)
+	}
+	err = p.EnsureSchemaHistoryTable(ctx)
+	if err != nil {
+		panic(err)
+	}
 
-	p.watchCubes()
+	NewScheduler(p, workers).Run(ctx, cubes, reloads)
 }
 
-func DeleteCubes(clickhouse clickhouse.Clickhouse, cubes Cubes) error {
-	p := NewPlaton("")
+func DeleteCubes(ctx context.Context, clickhouse clickhouse.Clickhouse, cubes Cubes) error {
+	p := NewPlaton(PrometheusConfig{})
 	p.Cubes = cubes
 	p.Database = clickhouse
 
 	for _, cube := range p.Cubes.Cubes {
-		sql := fmt.Sprintf("DROP TABLE IF EXISTS %s", cube.Name)
-		fmt.Println(sql)
+		sql := fmt.Sprintf("DROP TABLE IF EXISTS %s", quoteIdentifier(cube.Name))
 
-		err := p.Database.Connection.Exec(p.ctx, sql)
+		err := p.exec(ctx, sql)
 		if err != nil {
 			return fmt.Errorf("failed to create cube table: %w", err)
 		}
 		for _, query := range cube.Queries {
-			sql := fmt.Sprintf("DROP TABLE IF EXISTS %s", query.Name)
-			fmt.Println(sql)
+			sql := fmt.Sprintf("DROP TABLE IF EXISTS %s", quoteIdentifier(query.Name))
 
-			err := p.Database.Connection.Exec(p.ctx, sql)
+			err := p.exec(ctx, sql)
 			if err != nil {
 				return fmt.Errorf("failed to drop metrics table: %w", err)
 			}
 		}
+		err = p.ClearSyncState(ctx, cube.Name)
+		if err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-func ValueHelp(metric, dimension, prometheusUrl string) error {
-	p := NewPlaton(prometheusUrl)
+func ValueHelp(metric, dimension string, prometheus PrometheusConfig) error {
+	p := NewPlaton(prometheus)
 
-	values, err := p.queryValues(metric, dimension)
+	values, err := p.queryValues(context.Background(), metric, dimension)
 	if err != nil {
 		return fmt.Errorf("failed to query metric %s: %w", metric, err)
 	}
@@ -90,15 +123,18 @@ func ValueHelp(metric, dimension, prometheusUrl string) error {
 	return nil
 }
 
-func (p *Platon) queryValues(metric, dimension string) ([]string, error) {
+func (p *Platon) queryValues(ctx context.Context, metric, dimension string) ([]string, error) {
 	values := []string{}
-	samples, err := p.GetSamples(metric, time.Now().Add(-1*DefaultRange), time.Now())
+	samples, err := p.GetSamples(ctx, metric, time.Now().Add(-1*DefaultRange), time.Now(), DefaultStep, DefaultTimeout)
 	if err != nil {
 		return values, fmt.Errorf("failed to query prometheus for metric %s: %w", metric, err)
 	}
-	matrix := samples.(model.Matrix)
-	for _, sampleStream := range matrix {
-		for label, value := range sampleStream.Metric {
+	series, err := resultLabels(samples)
+	if err != nil {
+		return values, fmt.Errorf("failed to read result of metric %s: %w", metric, err)
+	}
+	for _, labels := range series {
+		for label, value := range labels {
 			if string(label) != dimension || slices.Contains(values, string(value)) {
 				continue
 			}
@@ -109,25 +145,10 @@ func (p *Platon) queryValues(metric, dimension string) ([]string, error) {
 
 }
 
-func (p *Platon) watchCubes() {
-	for {
-		for _, cube := range p.Cubes.Cubes {
-			if cube.LastUpdate.Add(cube.ScrapeInterval).After(time.Now()) {
-				continue
-			}
-
-			fmt.Printf("Updating cube %s.\n", cube.Name)
-			p.UpdateCube(cube)
-			cube.LastUpdate = time.Now()
-		}
-		time.Sleep(1 * time.Minute)
-	}
-}
-
-func NewPlaton(prometheusUrl string) *Platon {
+func NewPlaton(prometheus PrometheusConfig) *Platon {
 	p := Platon{
-		PrometheusUrl: prometheusUrl,
-		ctx:           context.Background(),
+		Prometheus: prometheus,
+		views:      map[string]string{},
 	}
 
 	client, err := p.getPromClient()
@@ -138,60 +159,139 @@ func NewPlaton(prometheusUrl string) *Platon {
 	return &p
 }
 
-func (p *Platon) UpdateCube(cube Cube) {
+// UpdateCube syncs a cube from its stored watermarks until now.
+func (p *Platon) UpdateCube(ctx context.Context, cube Cube) (SyncSummary, error) {
+	watermarks, err := p.GetSyncState(ctx, cube)
+	if err != nil {
+		return SyncSummary{Cube: cube.Name}, err
+	}
+	// Syncing offset before now leaves time for late samples to arrive
+	end := time.Now().Add(-cube.GetOffset())
+	if cube.Dedup == DedupToken {
+		// Windows ending on scrape interval boundaries only insert complete parts, see insertBatches
+		end = end.Truncate(cube.GetScrapeInterval())
+	}
+	starts := cube.syncStarts(watermarks, end)
+	if start := earliestStart(starts); start.After(end) {
+		fmt.Printf("Cube %s is already synced until %s.\n", cube.Name, end.Format(time.RFC3339))
+		return SyncSummary{Cube: cube.Name, Start: start, End: end}, nil
+	}
 
+	return p.syncCube(ctx, cube, starts, end, watermarks, true)
+}
+
+// syncCube queries every cube query for the range between its start and end
+// and inserts the per-query and the joined cube tables. Only rows newer than
+// the watermark of their table are inserted. If commit is set, the watermarks
+// are advanced to end after each successful insert.
+//
+// Cancelling ctx stops the sync between queries. A table insert which has
+// already started is completed and its watermark stored, so the next sync
+// resumes after the last completely inserted table.
+func (p *Platon) syncCube(ctx context.Context, cube Cube, starts map[string]time.Time, end time.Time, watermarks map[string]time.Time, commit bool) (SyncSummary, error) {
+	summary := SyncSummary{Cube: cube.Name, Start: earliestStart(starts), End: end}
 	tables := []Table{}
+	insertCtx := context.WithoutCancel(ctx)
 
-	start := time.Now().Add(-1 * DefaultRange)
-	if !cube.LastUpdate.IsZero() {
-		start = cube.LastUpdate.Add(1 * time.Minute)
-	}
-	end := time.Now()
 	for _, query := range cube.Queries {
+		if err := ctx.Err(); err != nil {
+			return summary, err
+		}
 		fmt.Printf("Querying prometheus: %s\n", query.PromQL)
+		start := starts[query.Name]
+		if start.After(end) {
+			// Already synced until end, the range query only returns the sample at end
+			start = end
+		}
 
-		queryResult, err := p.GetSamples(string(query.PromQL), start, end)
+		queryResult, err := p.querySamples(ctx, cube, query, start, end)
 		if err != nil {
-			panic(err)
+			return summary, err
 		}
 
 		table, err := MetricsToTable(query, queryResult)
 		if err != nil {
-			panic(err)
+			return summary, err
 		}
+		table.Options = cube.tableOptions(table)
 
 		tables = append(tables, table)
 		table.PrettyPrint(10)
 
-		err = p.EnsureTable(table)
+		err = p.EnsureTable(ctx, table)
+		if err != nil {
+			return summary, err
+		}
+
+		newRows := table.SyncWindow(start, end, watermarks[query.Name])
+		written, err := p.InsertData(insertCtx, newRows)
+		summary.Tables = append(summary.Tables, TableSummary{
+			Table:        table.Name,
+			Query:        query.Name,
+			RowsFetched:  len(table.Rows),
+			RowsInserted: written,
+		})
 		if err != nil {
-			panic(err)
+			return summary, fmt.Errorf("failed to add data to table %s: %w", table.Name, err)
+		}
+		if written != len(newRows.Rows) {
+			return summary, fmt.Errorf("inserted %d of %d rows into table %s", written, len(newRows.Rows), table.Name)
 		}
 
-		err = p.InsertData(table)
+		if commit {
+			err = p.SetSyncState(insertCtx, cube.Name, query.Name, end)
+			if err != nil {
+				return summary, err
+			}
+		}
+	}
+	if cube.GetJoinMode() == JoinModeSQL {
+		err := p.ensureView(ctx, cube, tables)
 		if err != nil {
-			panic(fmt.Errorf("failed to add data to table %s: %v", table.Name, err))
+			return summary, err
 		}
+		if commit {
+			err = p.SetSyncState(insertCtx, cube.Name, cubeStateKey, end)
+			if err != nil {
+				return summary, err
+			}
+		}
+		return summary, nil
 	}
+
 	fullTable, err := p.generateFullTable(cube, tables)
 	if err != nil {
-		panic(err)
+		return summary, err
 	}
+	fullTable.Options = cube.tableOptions(fullTable)
 
-	err = p.EnsureTable(fullTable)
+	err = p.EnsureTable(ctx, fullTable)
 	if err != nil {
-		panic(err)
+		return summary, err
 	}
 
-	err = p.InsertData(fullTable)
+	newRows := fullTable.SyncWindow(summary.Start, end, watermarks[cubeStateKey])
+	written, err := p.InsertData(insertCtx, newRows)
+	summary.Tables = append(summary.Tables, TableSummary{
+		Table:        fullTable.Name,
+		RowsFetched:  len(fullTable.Rows),
+		RowsInserted: written,
+	})
 	if err != nil {
-		panic(fmt.Errorf("failed to add data to table %s: %v", fullTable.Name, err))
+		return summary, fmt.Errorf("failed to add data to table %s: %w", fullTable.Name, err)
+	}
+	if written != len(newRows.Rows) {
+		return summary, fmt.Errorf("inserted %d of %d rows into table %s", written, len(newRows.Rows), fullTable.Name)
+	}
+
+	if commit {
+		err = p.SetSyncState(insertCtx, cube.Name, cubeStateKey, end)
+		if err != nil {
+			return summary, err
+		}
 	}
 
-	//err := p.createView(cube, tables)
-	//if err != nil {
-	//	panic(err)
-	//}
+	return summary, nil
 }
 
 func (p *Platon) generateFullTable(cube Cube, tables []Table) (Table, error) {
@@ -213,7 +313,38 @@ func (p *Platon) generateFullTable(cube Cube, tables []Table) (Table, error) {
 	return left, nil
 }
 
+// platonLeftJoin joins the right table to the left table on the cube's joined
+// labels and Time. A joined label missing in a row is treated as an empty
+// value. Dimensions of the right table which are not joined labels are
+// prefixed with the right table's name.
+//
+// For every join key with L matching left and R matching right rows:
+//
+//   - L=0 (right only): each right row is added as a new row. Dimensions and
+//     metrics of the left table are empty.
+//   - R=0 (left only): the left rows are kept. Dimensions and metrics of the
+//     right table are empty.
+//   - L=1, R=1 (one-to-one): dimensions and metrics of the right row are merged
+//     into the left row.
+//   - L>1 or R>1 (one-to-many, many-to-one, many-to-many): the rows can't be
+//     matched unambiguously and are joined according to the cube's join strategy:
+//     JoinRollup and JoinNull keep every metric value exactly once. The left
+//     rows keep their own values and get the ambiguity marker "*" (or NULL)
+//     for all dimensions of the right table. Each right row is added as a new
+//     row with the marker for all dimensions of the left table.
+//     JoinExplode merges every left row with every right row.
+//     JoinAggregate aggregates the right rows to a single row per join key
+//     before joining, using the query's aggregation.
 func (left Table) platonLeftJoin(cube Cube, right Table) (Table, error) {
+	strategy := cube.GetJoinStrategy()
+	if strategy == JoinAggregate {
+		var err error
+		right, err = right.aggregateToJoinKey(cube)
+		if err != nil {
+			return Table{}, err
+		}
+	}
+
 	joinedTable := Table{
 		Dimensions: []string{},
 		Rows:       []*Row{},
@@ -222,14 +353,21 @@ func (left Table) platonLeftJoin(cube Cube, right Table) (Table, error) {
 	// Set up dimensions & metrics
 	joinedTable.Dimensions = append(joinedTable.Dimensions, left.Dimensions...)
 	joinedTable.Metrics = append(joinedTable.Metrics, left.Metrics...)
+	rightDimensions := []string{}
 	for _, d := range right.Dimensions {
-		col := d
-		if !slices.Contains(cube.JoinedLabels, d) && d != "Time" {
-			col = fmt.Sprintf("%s_%s", right.Name, d)
-		}
+		col := right.joinedDimension(cube, d)
 		if !slices.Contains(joinedTable.Dimensions, col) {
 			joinedTable.Dimensions = append(joinedTable.Dimensions, col)
 		}
+		if !slices.Contains(cube.JoinedLabels, d) {
+			rightDimensions = append(rightDimensions, col)
+		}
+	}
+	leftDimensions := []string{}
+	for _, d := range left.Dimensions {
+		if !slices.Contains(cube.JoinedLabels, d) {
+			leftDimensions = append(leftDimensions, d)
+		}
 	}
 	joinedTable.Metrics = append(joinedTable.Metrics, right.Metrics...)
 
@@ -238,198 +376,106 @@ func (left Table) platonLeftJoin(cube Cube, right Table) (Table, error) {
 		joinedTable.InsertRow(r)
 	}
 
-	// Right table - for each row:
-	// * Count matches (all joined dimensions match) in left table.
-	// ** If 0 matches, create a new row, setting all non-existent dimensions in the right table to NULL
-	// ** If one match, count matches in right table.
-	// *** If one match, insert values
-	// *** If more than one match, create a new row, setting all non-existent dimensions in the right table to '*'
-	// *** Update matching row in joined table row and set all dimensions of the right table to '*'
-	// ** If more than one match, create a new row, setting all non-existent dimensions in right table to '*'
+	leftIndex := newJoinIndex(cube.JoinedLabels, left.Rows)
+	rightIndex := newJoinIndex(cube.JoinedLabels, right.Rows)
 
+	// Keys whose left matches have been exploded or marked ambiguous, which
+	// only has to happen once per key, not for every right row of the key
+	explodedKeys := map[string]bool{}
+	ambiguousKeys := map[string]bool{}
 	for _, r := range right.Rows {
-		leftMatches, err := left.CountMatches(cube.JoinedLabels, r)
-		if err != nil {
-			return Table{}, fmt.Errorf("failed to count matches between tables %s and %s: %w", left.Name, right.Name, err)
-		}
-		switch leftMatches {
-		case 0:
-			newRow := Row{Time: r.Time, Metrics: r.Metrics}
-			for d, v := range r.Dimensions {
-				newDim := d
-				if !slices.Contains(cube.JoinedLabels, d) {
-					newDim = fmt.Sprintf("%s_%s", right.Name, d)
-				}
-				newRow.Dimensions[newDim] = v
-			}
-			joinedTable.InsertRow(&newRow)
-		case 1:
-			rightMatches, err := right.CountMatches(cube.JoinedLabels, r)
-			if err != nil {
-				return Table{}, fmt.Errorf("failed to count matches between tables %s and %s: %w", left.Name, right.Name, err)
-			}
-			matchingRow, err := joinedTable.GetFirstMatchingRow(cube.JoinedLabels, r)
-			if err != nil {
-				return Table{}, fmt.Errorf("failed to get matching row in joined table when joining %s and %s", left.Name, right.Name)
-			}
-			if rightMatches == 1 {
-				for d, v := range r.Dimensions {
-					newDim := d
-					if !slices.Contains(cube.JoinedLabels, d) {
-						newDim = fmt.Sprintf("%s_%s", right.Name, d)
-					}
-					matchingRow.Dimensions[newDim] = v
-				}
-				for m, v := range r.Metrics {
-					matchingRow.Metrics[m] = v
-				}
-				continue
-			}
+		key := rightIndex.key(r)
+		leftMatches := leftIndex.rows[key]
+		rightMatches := rightIndex.rows[key]
 
-			newRow := Row{Time: r.Time, Metrics: r.Metrics}
-			for d, v := range r.Dimensions {
-				newDim := d
-				if !slices.Contains(cube.JoinedLabels, d) {
-					newDim = fmt.Sprintf("%s_%s", right.Name, d)
-				}
-				newRow.Dimensions[newDim] = v
-				matchingRow.Dimensions[newDim] = "*"
-			}
-			for _, d := range joinedTable.Dimensions {
-				_, ok := newRow.Dimensions[d]
-				if !ok {
-					newRow.Dimensions[d] = "*"
-				}
-			}
-			joinedTable.InsertRow(&newRow)
-
-		default:
-			newRow := Row{Time: r.Time, Metrics: r.Metrics, Dimensions: map[string]string{}}
-			for d, v := range r.Dimensions {
-				newDim := d
-				if !slices.Contains(cube.JoinedLabels, d) {
-					newDim = fmt.Sprintf("%s_%s", right.Name, d)
-				}
-				newRow.Dimensions[newDim] = v
-			}
-			for _, d := range joinedTable.Dimensions {
-				_, ok := newRow.Dimensions[d]
-				if !ok {
-					newRow.Dimensions[d] = "*"
-				}
-			}
-			joinedTable.InsertRow(&newRow)
+		if len(leftMatches) == 1 && len(rightMatches) == 1 {
+			right.mergeInto(cube, leftMatches[0], r)
+			continue
 		}
-	}
 
-	return joinedTable, nil
-}
-
-func (p *Platon) createView(cube Cube, tables []Table) error {
-
-	columnsWithAlias := []string{}
-	for i, t := range tables {
-		for _, c := range t.GetColumns() {
-			if slices.Contains(cube.GetMetricColumns(), c.Name) {
-				// metric column, aggregate values
-				columnsWithAlias = append(columnsWithAlias, fmt.Sprintf("%s(\"T%d\".\"%s\") \"%s\"", cube.GetAggregation(c.Name), i, c.Name, c.Name))
+		if strategy == JoinExplode && len(leftMatches) > 0 {
+			if explodedKeys[key] {
 				continue
 			}
-			if i == 0 && (slices.Contains(cube.JoinedLabels, c.Name) || c.Name == "Time") {
-				// join key, use original value
-				columnsWithAlias = append(columnsWithAlias, fmt.Sprintf("\"T%d\".\"%s\" \"%s\"", i, c.Name, c.Name))
-				continue
+			explodedKeys[key] = true
+			for _, leftRow := range leftMatches {
+				original := leftRow.clone()
+				for i, rightRow := range rightMatches {
+					target := leftRow
+					if i > 0 {
+						target = original.clone()
+						joinedTable.InsertRow(target)
+					}
+					right.mergeInto(cube, target, rightRow)
+				}
 			}
-			// additional column, make array and prefix column name
-			columnsWithAlias = append(columnsWithAlias, fmt.Sprintf("\"T%d\".\"%s\" \"%s.%s\"", i, c.Name, t.Name, c.Name))
-		}
-	}
-
-	ctx := context.Background()
-
-	viewSqlBuilder := sb.ClickHouse.NewSelectBuilder()
-	viewSqlBuilder = viewSqlBuilder.Select(columnsWithAlias...)
-	unionSqls := []string{}
-
-	joinCols := append(cube.JoinedLabels, "Time")
-	leftTableColumns := []string{}
-	for _, c := range tables[0].GetColumns() {
-		if slices.Contains(joinCols, c.Name) {
-			leftTableColumns = append(leftTableColumns, c.Name)
 			continue
 		}
-		leftTableColumns = append(leftTableColumns, fmt.Sprintf("MAX(\"%s\") \"%s\"", c.Name, c.Name))
-	}
 
-	for i, table := range tables {
-		if i == 0 {
-			viewSqlBuilder = viewSqlBuilder.From(table.Name + " T0")
-			continue
-		}
-		onExpr := []string{}
-		for _, joinCol := range joinCols {
-			onExpr = append(onExpr, fmt.Sprintf("T0.%s=T%d.%s", joinCol, i, joinCol))
-		}
-		rightTableColumns := []string{}
-		for _, c := range table.GetColumns() {
-			if slices.Contains(joinCols, c.Name) {
-				rightTableColumns = append(rightTableColumns, c.Name)
-				continue
+		newRow := NewRow(r.Time)
+		right.mergeInto(cube, newRow, r)
+		if len(leftMatches) > 0 {
+			for _, d := range leftDimensions {
+				setAmbiguous(strategy, newRow, d)
+			}
+			if !ambiguousKeys[key] {
+				ambiguousKeys[key] = true
+				for _, matchingRow := range leftMatches {
+					for _, d := range rightDimensions {
+						setAmbiguous(strategy, matchingRow, d)
+					}
+				}
 			}
-			rightTableColumns = append(rightTableColumns, fmt.Sprintf("MAX(\"%s\") \"%s\"", c.Name, c.Name))
 		}
-		rightTableJoinBuilder := sb.ClickHouse.NewSelectBuilder().Select(rightTableColumns...).From(table.Name + " T" + strconv.Itoa(i))
-		rightTableJoinBuilder = rightTableJoinBuilder.GroupBy(joinCols...).Having("COUNT(Time) = 1")
-		rightTableSelect, _ := rightTableJoinBuilder.Build()
-
-		leftTableJoinBuilder := sb.ClickHouse.NewSelectBuilder().Select(leftTableColumns...).From(table.Name)
-		leftTableJoinBuilder = leftTableJoinBuilder.GroupBy(joinCols...).Having("COUNT(Time) != 1")
-		leftTableSelect, _ := leftTableJoinBuilder.Build()
-
-		rightTableUnionBuilder := sb.ClickHouse.NewSelectBuilder().Select(rightTableColumns...).From(table.Name+" T"+strconv.Itoa(i)).JoinWithOption("INNER ANY", "("+leftTableSelect+") T0", onExpr...).GroupBy(joinCols...)
-		rightTableUnionSql, _ := rightTableUnionBuilder.Build()
-		unionSqls = append(unionSqls, rightTableUnionSql)
-
-		viewSqlBuilder = viewSqlBuilder.JoinWithOption("LEFT", "("+rightTableSelect+") T1", onExpr...).GroupBy(joinCols...)
-	}
-	selectSql, _ := viewSqlBuilder.Build()
-	viewSql := "CREATE OR REPLACE VIEW " + cube.Name + " AS " + selectSql
-	if len(unionSqls) > 0 {
-		viewSql += " UNION ALL " + strings.Join(unionSqls, " UNION ALL ")
+		joinedTable.InsertRow(newRow)
 	}
 
-	fmt.Println("Executing SQL: " + viewSql)
+	return joinedTable, nil
+}
 
-	err := p.Database.Connection.Exec(ctx, viewSql)
-	if err != nil {
-		return fmt.Errorf("failed to CREATE or UPDATE cube view: %w", err)
+// joinedDimension returns the name of a dimension of the table in a joined
+// table. Joined labels keep their name, all others are prefixed with the table name.
+func (t Table) joinedDimension(cube Cube, dimension string) string {
+	if slices.Contains(cube.JoinedLabels, dimension) {
+		return dimension
 	}
-
-	return nil
+	return fmt.Sprintf("%s_%s", t.Name, dimension)
 }
 
-func (p *Platon) EnsureTable(table Table) error {
-	exists, err := p.TableExists(table)
+func (p *Platon) EnsureTable(ctx context.Context, table Table) error {
+	exists, err := p.TableExists(ctx, table)
 	if err != nil {
 		return fmt.Errorf("failed to figure out if table %s exists: %v", table.Name, err)
 	}
 	if exists {
-		err = p.EnsureColumns(table)
+		err = p.EnsureEngine(ctx, table)
+		if err != nil {
+			return fmt.Errorf("failed to update table %s: %v", table.Name, err)
+		}
+		err = p.ApplyMigrations(ctx, table)
+		if err != nil {
+			return fmt.Errorf("failed to update table %s: %v", table.Name, err)
+		}
+		err = p.EnsureTtl(ctx, table)
+		if err != nil {
+			return fmt.Errorf("failed to update table %s: %v", table.Name, err)
+		}
+		err = p.EnsureDeduplicationWindow(ctx, table)
 		if err != nil {
 			return fmt.Errorf("failed to update table %s: %v", table.Name, err)
 		}
 		return nil
 	}
-	err = p.CreateTable(table)
+	err = p.CreateTable(ctx, table)
 	if err != nil {
 		return fmt.Errorf("failed to create table %s: %v", table.Name, err)
 	}
 	return nil
 }
 
-func (p *Platon) TableExists(table Table) (bool, error) {
-	sql := fmt.Sprintf("EXISTS TABLE %s", table.Name)
-	row := p.Database.Connection.QueryRow(p.ctx, sql)
+func (p *Platon) TableExists(ctx context.Context, table Table) (bool, error) {
+	sql := fmt.Sprintf("EXISTS TABLE %s", quoteIdentifier(table.Name))
+	row := p.Database.Connection.QueryRow(ctx, sql)
 	var existsCol uint8
 	if err := row.Scan(&existsCol); err != nil {
 		return false, fmt.Errorf("failed to query result row of sql '%s': %w", sql, err)
@@ -438,15 +484,15 @@ func (p *Platon) TableExists(table Table) (bool, error) {
 	return existsCol == 1, nil
 }
 
-func (p *Platon) EnsureColumns(table Table) error {
-
-	sql := fmt.Sprintf("DESCRIBE TABLE %s", table.Name)
-	fmt.Printf("Executing sql: %s", sql)
-	rows, err := p.Database.Connection.Query(p.ctx, sql)
+// DescribeTable returns the columns of an existing table.
+func (p *Platon) DescribeTable(ctx context.Context, name string) ([]Column, error) {
+	sql := fmt.Sprintf("DESCRIBE TABLE %s", quoteIdentifier(name))
+	rows, err := p.Database.Connection.Query(ctx, sql)
 	if err != nil {
-		return fmt.Errorf("failed to query table columns with sql '%s': %w", sql, err)
+		return nil, fmt.Errorf("failed to query table columns with sql '%s': %w", sql, err)
 	}
-	columnNames := []string{}
+	defer rows.Close()
+	columns := []Column{}
 	for rows.Next() {
 		var (
 			columnName        string
@@ -459,147 +505,94 @@ func (p *Platon) EnsureColumns(table Table) error {
 		)
 		err = rows.Scan(&columnName, &columnType, &defaultType, &defaultExpression, &comment, &codec, &ttl)
 		if err != nil {
-			return fmt.Errorf("failed to scan table columns from sql '%s': %w", sql, err)
+			return nil, fmt.Errorf("failed to scan table columns from sql '%s': %w", sql, err)
 		}
-		fmt.Println("---")
-		fmt.Printf("Name: %s\n", columnName)
-		fmt.Printf("Type: %s\n", columnType)
-		fmt.Printf("defaultype: %s\n", defaultType)
-		fmt.Printf("defaultexpression: %s\n", defaultExpression)
-		fmt.Printf("Comment: %s\n", comment)
-		fmt.Printf("Codec: %s\n", codec)
-		fmt.Printf("ttl: %s\n", ttl)
-		columnNames = append(columnNames, columnName)
+		columns = append(columns, Column{Name: columnName, DataType: columnType, Default: defaultExpression, Codec: strings.Join(splitCodecs(codec), ", ")})
 	}
-
-	fmt.Printf("%d columns found in table %s: %v\n", len(columnNames), table.Name, columnNames)
-
-	for _, expectedCol := range table.GetColumns() {
-		if slices.Contains(columnNames, expectedCol.Name) {
-			continue
-		}
-		sql := fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table.Name, expectedCol.Name, expectedCol.DataType)
-		fmt.Printf("Executing sql: %s", sql)
-		err := p.Database.Connection.Exec(p.ctx, sql)
-		if err != nil {
-			return fmt.Errorf("failed to update cube table %s with SQL '%s': %w", table.Name, sql, err)
-		}
-
-	}
-
-	return nil
+	return columns, rows.Err()
 }
 
-func (p *Platon) CreateTable(table Table) error {
+func (p *Platon) CreateTable(ctx context.Context, table Table) error {
 	cols := table.GetColumns()
 	columns := ""
 	for _, c := range cols {
-		columns = columns + c.Name + " " + c.DataType + ","
+		columns = columns + c.Definition() + ","
 	}
 	columns = columns[:len(columns)-1]
-	sql := fmt.Sprintf("CREATE TABLE %s (%s) PRIMARY KEY(Time)", table.Name, columns)
-	fmt.Println(sql)
+	sql := fmt.Sprintf("CREATE TABLE %s (%s) %s", quoteIdentifier(table.Name), columns, table.engineClause())
 
-	err := p.Database.Connection.Exec(p.ctx, sql)
+	err := p.exec(ctx, sql)
 	if err != nil {
 		return fmt.Errorf("failed to create cube table: %w", err)
 	}
-	return nil
+	return p.recordMigration(ctx, table, MigrationCreate, sql)
 }
-func (p *Platon) InsertData(table Table) error {
-	cols := table.GetColumns()
-	for i := 0; i < len(table.Rows)/100; i++ {
-		batch, err := p.Database.Connection.PrepareBatch(p.ctx, "INSERT INTO "+table.Name+" ("+strings.Join(table.GetQuotedColumnNames(), ", ")+")")
-		if err != nil {
-			return err
-		}
-		for j := i * 100; j < len(table.Rows) && j < (i+1)*100; j++ {
-			//fmt.Printf("Adding %v", table.Rows[i].GetOrderedValues(cols)...)
-			err = batch.Append(table.Rows[j].GetOrderedValues(cols)...)
-			if err != nil {
-				return fmt.Errorf("failed to add row to batch: %w", err)
-			}
-		}
-		err = batch.Send()
-		if err != nil {
-			return fmt.Errorf("failed to execute batch batch: %w", err)
-		}
+
+// exec executes a statement modifying ClickHouse. In dry-run mode the
+// statement is only printed.
+func (p *Platon) exec(ctx context.Context, sql string, args ...any) error {
+	if p.DryRun {
+		fmt.Printf("Would execute: %s %v\n", sql, args)
+		return nil
 	}
-	return nil
+	fmt.Printf("Executing sql: %s\n", sql)
+	return p.Database.Connection.Exec(ctx, sql, args...)
 }
 
-var promClient api.Client
-var promClientInitialized bool = false
-
-func (p *Platon) getPromClient() (api.Client, error) {
-	if promClientInitialized {
-		return promClient, nil
+// InsertData inserts all rows of the table in batches of the table's batch
+// size and returns the number of rows written.
+func (p *Platon) InsertData(ctx context.Context, table Table) (int, error) {
+	if table.Options.Dedup == DedupDelete && !table.Start.IsZero() {
+		err := p.deleteWindow(ctx, table)
+		if err != nil {
+			return 0, err
+		}
 	}
-
-	var err error
-	httpClient := http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-		},
+	if p.DryRun {
+		fmt.Printf("Would insert %d rows into table %s.\n", len(table.Rows), table.Name)
+		return len(table.Rows), p.replaceSnapshot(ctx, table)
 	}
-	promClient, err = api.NewClient(api.Config{
-		Address: p.PrometheusUrl,
-		Client:  &httpClient,
-	})
-
-	if err != nil {
-		return nil, fmt.Errorf("error creating client: %v", err)
+	batchSize := table.Options.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
 	}
-	promClientInitialized = true
-
-	return promClient, nil
-}
-
-func (p *Platon) GetMetrics(metricsFilter ...string) ([]Metric, error) {
-	v1api := v1.NewAPI(p.Client)
-	labels, warnings, err := v1api.LabelValues(context.Background(), "__name__", []string{}, p.StartTime, p.EndTime)
-	// Always log the warnings even if errors cause crash
-	if len(warnings) > 0 {
-		fmt.Printf("Warnings: %v\n", warnings)
+	if table.Options.AsyncInsert {
+		ctx = clickhouse.AsyncInsertContext(ctx)
 	}
-	if err != nil {
-		return nil, err
-	}
-	metrics := []Metric{}
-	for i := range labels {
-		metricName := string(labels[i])
-		if len(metricsFilter) > 0 && !slices.Contains(metricsFilter, metricName) {
-			continue
+	cols := table.InsertColumns()
+	written := 0
+	for _, insert := range table.insertBatches(batchSize) {
+		batchCtx := ctx
+		if insert.Token != "" {
+			batchCtx = clickhouse.DeduplicationTokenContext(ctx, insert.Token)
 		}
-		//Query metric to identify dimensions
-		samples, err := p.GetSamples(metricName, time.Now().Add(-1*DefaultRange), time.Now())
+		batch, err := p.Database.Connection.PrepareBatch(batchCtx, "INSERT INTO "+quoteIdentifier(table.Name)+" ("+strings.Join(table.GetQuotedColumnNames(), ", ")+")")
 		if err != nil {
-			return nil, fmt.Errorf("failed to query metric %s: %w", metricName, err)
-		}
-		metric := Metric{
-			Name: metricName,
+			return written, err
 		}
-		matrix := samples.(model.Matrix)
-		for _, sampleStream := range matrix {
-			for label, _ := range sampleStream.Metric {
-				if string(label) == "__name__" {
-					continue
-				}
-				if !slices.Contains(metric.Dimensions, string(label)) {
-					metric.Dimensions = append(metric.Dimensions, string(label))
-				}
+		for _, row := range insert.Rows {
+			err = batch.Append(row.GetOrderedValues(cols)...)
+			if err != nil {
+				batch.Abort()
+				return written, fmt.Errorf("failed to add row to batch: %w", err)
 			}
 		}
-
-		metrics = append(metrics, metric)
+		rows := batch.Rows()
+		err = batch.Send()
+		if err != nil {
+			return written, fmt.Errorf("failed to execute batch: %w", err)
+		}
+		written += rows
 	}
-	return metrics, nil
+	fmt.Printf("Inserted %d rows into table %s.\n", written, table.Name)
+	return written, p.replaceSnapshot(ctx, table)
 }
 
-func GenerateCube(cubeName string, metricNames []string, prometheusUrl string) Cubes {
+func GenerateCube(cubeName string, metricNames []string, prometheus PrometheusConfig, discovery DiscoveryConfig) Cubes {
 	cubes := Cubes{}
-	p := NewPlaton(prometheusUrl)
-	metrics, err := p.GetMetrics(metricNames...)
+	p := NewPlaton(prometheus)
+	p.Discovery = discovery
+	metrics, err := p.GetMetrics(context.Background(), metricNames...)
 	if err != nil {
 		panic(err)
 	}
@@ -607,8 +600,7 @@ func GenerateCube(cubeName string, metricNames []string, prometheusUrl string) C
 	cube := Cube{
 		Name:           cubeName,
 		Description:    "My Cube",
-		Ttl:            DefaultRange,
-		ScrapeInterval: 1 * time.Minute,
+		ScrapeInterval: DefaultScrapeInterval,
 	}
 	commonLabels := []string{}
 	for i, metric := range metrics {
@@ -636,18 +628,13 @@ func GenerateCube(cubeName string, metricNames []string, prometheusUrl string) C
 	return cubes
 }
 
-func PrintDimensions(metricsFilter []string, prometheusUrl string) {
-	p := NewPlaton(prometheusUrl)
-	metrics, err := p.GetMetrics(metricsFilter...)
+func PrintDimensions(metricsFilter []string, prometheus PrometheusConfig, discovery DiscoveryConfig) {
+	p := NewPlaton(prometheus)
+	p.Discovery = discovery
+	allDimensions, err := p.GetLabelNames(context.Background(), metricsFilter...)
 	if err != nil {
 		panic(err)
 	}
-	allDimensions := []string{}
-	for _, metric := range metrics {
-		allDimensions = append(allDimensions, metric.Dimensions...)
-	}
-	slices.Sort(allDimensions)
-	allDimensions = slices.Compact(allDimensions)
 	fmt.Println("All Dimensions:")
 	for _, dim := range allDimensions {
 		fmt.Println(dim)
@@ -655,10 +642,11 @@ func PrintDimensions(metricsFilter []string, prometheusUrl string) {
 	fmt.Printf("%d dimensions found in Prometheus instance.\n", len(allDimensions))
 }
 
-func PrintMetrics(dimensionFilter []string, prometheusUrl string) {
-	p := NewPlaton(prometheusUrl)
+func PrintMetrics(dimensionFilter []string, prometheus PrometheusConfig, discovery DiscoveryConfig) {
+	p := NewPlaton(prometheus)
+	p.Discovery = discovery
 
-	metrics, err := p.GetMetrics()
+	metrics, err := p.GetMetrics(context.Background())
 	if err != nil {
 		panic(err)
 	}
@@ -686,10 +674,17 @@ metricLoop:
 	fmt.Printf("listing %d metrics out of %d found in Prometheus instance.\n", foundMetrics, len(metrics))
 }
 
-func (p *Platon) GetSamples(metric string, start, end time.Time) (model.Value, error) {
+// GetSamples runs a range query between start and end. Long ranges are split
+// into several queries, see SplitPoints.
+func (p *Platon) GetSamples(ctx context.Context, metric string, start, end time.Time, step, timeout time.Duration) (model.Value, error) {
+	return p.queryRangeSplit(ctx, metric, v1.Range{Start: start, End: end, Step: step}, timeout)
+}
+
+// queryRange runs a single range query.
+func (p *Platon) queryRange(ctx context.Context, metric string, r v1.Range, timeout time.Duration) (model.Value, error) {
 	v1api := v1.NewAPI(p.Client)
 
-	result, warnings, err := v1api.QueryRange(context.TODO(), metric, v1.Range{Start: start, End: end, Step: 1 * time.Minute}, v1.WithTimeout(5*time.Second))
+	result, warnings, err := v1api.QueryRange(ctx, metric, r, v1.WithTimeout(timeout))
 	// Always log the warnings even if errors cause crash
 	if len(warnings) > 0 {
 		fmt.Printf("Warnings: %v\n", warnings)
@@ -708,7 +703,10 @@ func MetricsToTable(query Query, queryResult model.Value) (Table, error) {
 		Rows:       []*Row{},
 	}
 
-	table.addQueryResult(query, queryResult)
+	err := table.addQueryResult(query, queryResult)
+	if err != nil {
+		return Table{}, err
+	}
 	fmt.Printf("Rows added to internal table: %d\n", len(table.Rows))
 	return table, nil
 }
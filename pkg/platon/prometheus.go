@@ -0,0 +1,133 @@
+package platon
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/prometheus/client_golang/api"
+)
+
+// PrometheusConfig holds the address and credentials of the Prometheus API.
+type PrometheusConfig struct {
+	URL string
+	// BearerToken is sent as Authorization header. BearerTokenFile takes
+	// precedence and is re-read on every request, so rotated tokens like
+	// in-cluster service account tokens are picked up.
+	BearerToken     string
+	BearerTokenFile string
+	// Username enables basic auth with Password or the content of PasswordFile.
+	Username     string
+	Password     string
+	PasswordFile string
+	// CertFile and KeyFile are the client certificate for mTLS.
+	CertFile           string
+	KeyFile            string
+	CAFile             string
+	InsecureSkipVerify bool
+	// ProxyURL overrides the proxy taken from the HTTP_PROXY/HTTPS_PROXY/NO_PROXY environment variables.
+	ProxyURL string
+}
+
+var promClient api.Client
+var promClientInitialized bool = false
+
+func (p *Platon) getPromClient() (api.Client, error) {
+	if promClientInitialized {
+		return promClient, nil
+	}
+
+	transport, err := p.Prometheus.transport()
+	if err != nil {
+		return nil, fmt.Errorf("error creating client: %v", err)
+	}
+	httpClient := http.Client{
+		Transport: transport,
+	}
+	promClient, err = api.NewClient(api.Config{
+		Address: p.Prometheus.URL,
+		Client:  &httpClient,
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("error creating client: %v", err)
+	}
+	promClientInitialized = true
+
+	return promClient, nil
+}
+
+func (c PrometheusConfig) transport() (http.RoundTripper, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+	if c.CAFile != "" {
+		ca, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("can't read prometheus CA file: %w", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in prometheus CA file %s", c.CAFile)
+		}
+	}
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("can't load prometheus client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	if c.ProxyURL != "" {
+		proxyURL, err := url.Parse(c.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("can't parse prometheus proxy URL: %w", err)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	if c.BearerToken == "" && c.BearerTokenFile == "" && c.Username == "" {
+		return transport, nil
+	}
+	return &authRoundTripper{config: c, next: transport}, nil
+}
+
+// authRoundTripper adds bearer token or basic auth credentials to every request.
+type authRoundTripper struct {
+	config PrometheusConfig
+	next   http.RoundTripper
+}
+
+func (rt *authRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+
+	switch {
+	case rt.config.BearerTokenFile != "":
+		token, err := os.ReadFile(rt.config.BearerTokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("can't read prometheus bearer token file: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	case rt.config.BearerToken != "":
+		req.Header.Set("Authorization", "Bearer "+rt.config.BearerToken)
+	case rt.config.Username != "":
+		password := rt.config.Password
+		if rt.config.PasswordFile != "" {
+			passwordBytes, err := os.ReadFile(rt.config.PasswordFile)
+			if err != nil {
+				return nil, fmt.Errorf("can't read prometheus password file: %w", err)
+			}
+			password = strings.TrimSpace(string(passwordBytes))
+		}
+		req.SetBasicAuth(rt.config.Username, password)
+	}
+
+	return rt.next.RoundTrip(req)
+}
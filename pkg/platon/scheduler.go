@@ -0,0 +1,164 @@
+package platon
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultWorkers        = 4
+	DefaultMinBackoff     = 10 * time.Second
+	DefaultMaxBackoff     = 10 * time.Minute
+	DefaultScrapeInterval = 1 * time.Minute
+)
+
+// Scheduler updates every cube on its own scrape interval. A cube failing to
+// update is retried with exponential backoff without affecting other cubes.
+type Scheduler struct {
+	platon     *Platon
+	workers    chan struct{}
+	running    map[string]*cubeRunner
+	wg         sync.WaitGroup
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// cubeRunner is the scheduling loop of a single cube.
+type cubeRunner struct {
+	cube   Cube
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewScheduler returns a scheduler running at most workers cube updates concurrently.
+func NewScheduler(p *Platon, workers int) *Scheduler {
+	if workers < 1 {
+		workers = DefaultWorkers
+	}
+	return &Scheduler{
+		platon:     p,
+		workers:    make(chan struct{}, workers),
+		running:    map[string]*cubeRunner{},
+		MinBackoff: DefaultMinBackoff,
+		MaxBackoff: DefaultMaxBackoff,
+	}
+}
+
+// Run starts one scheduling loop per cube and blocks until ctx is cancelled
+// and all running updates have finished. Cubes received on reloads replace
+// the running configuration.
+func (s *Scheduler) Run(ctx context.Context, cubes Cubes, reloads <-chan Cubes) {
+	s.apply(ctx, cubes)
+	for {
+		select {
+		case <-ctx.Done():
+			s.wg.Wait()
+			return
+		case cubes := <-reloads:
+			s.apply(ctx, cubes)
+		}
+	}
+}
+
+// apply starts loops for new cubes, stops loops of removed cubes and restarts
+// loops of changed cubes. Unchanged cubes keep their schedule.
+func (s *Scheduler) apply(ctx context.Context, cubes Cubes) {
+	wanted := map[string]Cube{}
+	for _, cube := range cubes.Cubes {
+		wanted[cube.Name] = cube
+	}
+
+	for name, runner := range s.running {
+		cube, ok := wanted[name]
+		if ok && reflect.DeepEqual(cube, runner.cube) {
+			continue
+		}
+		if ok {
+			fmt.Printf("Cube %s changed, restarting.\n", name)
+		} else {
+			fmt.Printf("Cube %s removed, stopping.\n", name)
+		}
+		runner.cancel()
+		<-runner.done
+		delete(s.running, name)
+	}
+
+	for _, cube := range cubes.Cubes {
+		if _, ok := s.running[cube.Name]; ok {
+			continue
+		}
+		s.start(ctx, cube)
+	}
+}
+
+func (s *Scheduler) start(ctx context.Context, cube Cube) {
+	cubeCtx, cancel := context.WithCancel(ctx)
+	runner := &cubeRunner{
+		cube:   cube,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	s.running[cube.Name] = runner
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer close(runner.done)
+		s.runCube(cubeCtx, cube)
+	}()
+}
+
+func (s *Scheduler) runCube(ctx context.Context, cube Cube) {
+	failures := 0
+	for {
+		err := s.updateCube(ctx, cube)
+		if ctx.Err() != nil {
+			fmt.Printf("Stopped syncing cube %s.\n", cube.Name)
+			return
+		}
+		wait := cube.GetScrapeInterval()
+		if err != nil {
+			failures++
+			wait = s.backoff(failures)
+			fmt.Printf("Failed to update cube %s (attempt %d), retrying in %s: %v\n", cube.Name, failures, wait, err)
+		} else {
+			failures = 0
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			fmt.Printf("Stopped syncing cube %s.\n", cube.Name)
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+func (s *Scheduler) updateCube(ctx context.Context, cube Cube) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case s.workers <- struct{}{}:
+	}
+	defer func() { <-s.workers }()
+
+	fmt.Printf("Updating cube %s.\n", cube.Name)
+	_, err := s.platon.UpdateCube(ctx, cube)
+	return err
+}
+
+func (s *Scheduler) backoff(failures int) time.Duration {
+	wait := s.MinBackoff
+	for i := 1; i < failures && wait < s.MaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > s.MaxBackoff {
+		wait = s.MaxBackoff
+	}
+	return wait
+}
@@ -0,0 +1,108 @@
+package platon
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+)
+
+var (
+	// SplitPoints is the maximum number of points per series of a single
+	// range query. Longer ranges are split, since Prometheus rejects more than
+	// MaxPointsPerSeries points and long ranges time out.
+	SplitPoints = 1440
+	// SplitConcurrency is the maximum number of concurrent queries of a split range.
+	SplitConcurrency = 4
+)
+
+// MaxSyncPoints is the maximum number of points per series of a regular or
+// initial sync window, which is split into up to 100 queries of MaxPointsPerSeries.
+const MaxSyncPoints = 100 * MaxPointsPerSeries
+
+// splitRange splits a range into consecutive sub-ranges of at most points
+// points. The sub-ranges start a multiple of the step after the range start,
+// so their samples have the same timestamps as the ones of the whole range.
+func splitRange(r v1.Range, points int) []v1.Range {
+	if r.Step <= 0 || points <= 0 {
+		return []v1.Range{r}
+	}
+	length := r.Step * time.Duration(points-1)
+	ranges := []v1.Range{}
+	for start := r.Start; !start.After(r.End); start = start.Add(length + r.Step) {
+		end := start.Add(length)
+		if end.After(r.End) {
+			end = r.End
+		}
+		ranges = append(ranges, v1.Range{Start: start, End: end, Step: r.Step})
+	}
+	return ranges
+}
+
+// queryRangeSplit runs a range query split into sub-ranges of at most
+// SplitPoints points, running SplitConcurrency of them at the same time.
+// The matrices of the sub-ranges are merged into a single matrix.
+func (p *Platon) queryRangeSplit(ctx context.Context, query string, r v1.Range, timeout time.Duration) (model.Value, error) {
+	ranges := splitRange(r, SplitPoints)
+	if len(ranges) == 1 {
+		return p.queryRange(ctx, query, r, timeout)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make([]model.Value, len(ranges))
+	errs := make([]error, len(ranges))
+	workers := make(chan struct{}, max(SplitConcurrency, 1))
+	wg := sync.WaitGroup{}
+	for i, subRange := range ranges {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			workers <- struct{}{}
+			defer func() { <-workers }()
+			if ctx.Err() != nil {
+				errs[i] = ctx.Err()
+				return
+			}
+			results[i], errs[i] = p.queryRange(ctx, query, subRange, timeout)
+			if errs[i] != nil {
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("failed to query range %s to %s: %w", ranges[i].Start.Format(time.RFC3339), ranges[i].End.Format(time.RFC3339), err)
+		}
+	}
+	return mergeMatrices(results)
+}
+
+// mergeMatrices merges the series of consecutive range query results,
+// appending the samples of series with the same labels in result order.
+func mergeMatrices(results []model.Value) (model.Matrix, error) {
+	merged := model.Matrix{}
+	streams := map[model.Fingerprint]*model.SampleStream{}
+	for _, result := range results {
+		matrix, ok := result.(model.Matrix)
+		if !ok {
+			return nil, fmt.Errorf("range query returned result type %s instead of %s", result.Type(), model.ValMatrix)
+		}
+		for _, sampleStream := range matrix {
+			fingerprint := sampleStream.Metric.Fingerprint()
+			stream, ok := streams[fingerprint]
+			if !ok {
+				stream = &model.SampleStream{Metric: sampleStream.Metric}
+				streams[fingerprint] = stream
+				merged = append(merged, stream)
+			}
+			stream.Values = append(stream.Values, sampleStream.Values...)
+			stream.Histograms = append(stream.Histograms, sampleStream.Histograms...)
+		}
+	}
+	return merged, nil
+}
@@ -0,0 +1,150 @@
+package platon
+
+import (
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+)
+
+// rangeTimestamps returns the timestamps of the samples of a range query.
+func rangeTimestamps(r v1.Range) []time.Time {
+	timestamps := []time.Time{}
+	for t := r.Start; !t.After(r.End); t = t.Add(r.Step) {
+		timestamps = append(timestamps, t)
+		if r.Step <= 0 {
+			break
+		}
+	}
+	return timestamps
+}
+
+func TestSplitRange(t *testing.T) {
+	at := func(minutes, seconds int) time.Time {
+		return joinTestTime.Add(time.Duration(minutes)*time.Minute + time.Duration(seconds)*time.Second)
+	}
+
+	tests := []struct {
+		name     string
+		r        v1.Range
+		points   int
+		expected []v1.Range
+	}{
+		{
+			name:   "exact",
+			r:      v1.Range{Start: at(0, 0), End: at(5, 0), Step: time.Minute},
+			points: 3,
+			expected: []v1.Range{
+				{Start: at(0, 0), End: at(2, 0), Step: time.Minute},
+				{Start: at(3, 0), End: at(5, 0), Step: time.Minute},
+			},
+		},
+		{
+			name:   "unaligned start and partial last range",
+			r:      v1.Range{Start: at(0, 30), End: at(10, 0), Step: time.Minute},
+			points: 3,
+			expected: []v1.Range{
+				{Start: at(0, 30), End: at(2, 30), Step: time.Minute},
+				{Start: at(3, 30), End: at(5, 30), Step: time.Minute},
+				{Start: at(6, 30), End: at(8, 30), Step: time.Minute},
+				{Start: at(9, 30), End: at(10, 0), Step: time.Minute},
+			},
+		},
+		{
+			name:     "single range",
+			r:        v1.Range{Start: at(0, 0), End: at(5, 0), Step: time.Minute},
+			points:   6,
+			expected: []v1.Range{{Start: at(0, 0), End: at(5, 0), Step: time.Minute}},
+		},
+		{
+			name:     "single point",
+			r:        v1.Range{Start: at(0, 0), End: at(0, 0), Step: time.Minute},
+			points:   3,
+			expected: []v1.Range{{Start: at(0, 0), End: at(0, 0), Step: time.Minute}},
+		},
+		{
+			name:     "no step",
+			r:        v1.Range{Start: at(0, 0), End: at(5, 0)},
+			points:   3,
+			expected: []v1.Range{{Start: at(0, 0), End: at(5, 0)}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ranges := splitRange(test.r, test.points)
+			if !reflect.DeepEqual(ranges, test.expected) {
+				t.Fatalf("expected ranges %v, got %v", test.expected, ranges)
+			}
+			// The sub-ranges must have the samples of the whole range, each exactly once
+			timestamps := []time.Time{}
+			for _, r := range ranges {
+				timestamps = append(timestamps, rangeTimestamps(r)...)
+			}
+			if expected := rangeTimestamps(test.r); !slices.Equal(timestamps, expected) {
+				t.Errorf("expected timestamps %v, got %v", expected, timestamps)
+			}
+		})
+	}
+}
+
+func TestMergeMatrices(t *testing.T) {
+	stream := func(pod string, timestamps ...int64) *model.SampleStream {
+		s := &model.SampleStream{Metric: model.Metric{"pod": model.LabelValue(pod)}}
+		for _, ts := range timestamps {
+			s.Values = append(s.Values, model.SamplePair{Timestamp: model.Time(ts), Value: model.SampleValue(ts)})
+		}
+		return s
+	}
+
+	tests := []struct {
+		name     string
+		results  []model.Value
+		expected model.Matrix
+	}{
+		{
+			name:     "no results",
+			results:  []model.Value{},
+			expected: model.Matrix{},
+		},
+		{
+			name: "series in all sub-ranges",
+			results: []model.Value{
+				model.Matrix{stream("a", 1, 2), stream("b", 1, 2)},
+				model.Matrix{stream("b", 3, 4), stream("a", 3, 4)},
+			},
+			expected: model.Matrix{stream("a", 1, 2, 3, 4), stream("b", 1, 2, 3, 4)},
+		},
+		{
+			name: "series in some sub-ranges",
+			results: []model.Value{
+				model.Matrix{stream("a", 1, 2), stream("b", 2)},
+				model.Matrix{},
+				model.Matrix{stream("c", 5), stream("a", 6)},
+			},
+			expected: model.Matrix{stream("a", 1, 2, 6), stream("b", 2), stream("c", 5)},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			merged, err := mergeMatrices(test.results)
+			if err != nil {
+				t.Fatalf("merge failed: %v", err)
+			}
+			if !reflect.DeepEqual(merged, test.expected) {
+				t.Errorf("expected matrix\n%v\ngot\n%v", test.expected, merged)
+			}
+		})
+	}
+
+	t.Run("vector result", func(t *testing.T) {
+		_, err := mergeMatrices([]model.Value{model.Matrix{stream("a", 1)}, model.Vector{}})
+		if err == nil {
+			t.Errorf("expected an error merging a vector")
+		}
+	})
+}
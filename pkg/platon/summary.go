@@ -0,0 +1,79 @@
+package platon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/platolytics/platon-mk3/pkg/db/clickhouse"
+)
+
+// SyncSummary reports the outcome of syncing a single cube.
+type SyncSummary struct {
+	Cube   string         `json:"cube"`
+	Start  time.Time      `json:"start"`
+	End    time.Time      `json:"end"`
+	Tables []TableSummary `json:"tables"`
+	Error  string         `json:"error,omitempty"`
+}
+
+// TableSummary reports the rows fetched from Prometheus and inserted into a table.
+// Query is empty for the joined cube table.
+type TableSummary struct {
+	Table        string `json:"table"`
+	Query        string `json:"query,omitempty"`
+	RowsFetched  int    `json:"rows_fetched"`
+	RowsInserted int    `json:"rows_inserted"`
+}
+
+// SyncOnce updates every cube exactly once from its stored watermark until now.
+// All cubes are synced even if some fail; the returned error joins all failures.
+// With options.DryRun, nothing is written to ClickHouse.
+func SyncOnce(ctx context.Context, clickhouse clickhouse.Clickhouse, cubes Cubes, prometheus PrometheusConfig, options Options) ([]SyncSummary, error) {
+	p := NewPlaton(prometheus)
+	p.Cubes = cubes
+	p.Database = clickhouse
+	p.Options = options
+
+	err := p.EnsureSyncStateTable(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = p.EnsureSchemaHistoryTable(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	summaries := []SyncSummary{}
+	errs := []error{}
+	for _, cube := range p.Cubes.Cubes {
+		fmt.Printf("Updating cube %s.\n", cube.Name)
+		summary, err := p.UpdateCube(ctx, cube)
+		if err != nil {
+			summary.Error = err.Error()
+			errs = append(errs, fmt.Errorf("failed to sync cube %s: %w", cube.Name, err))
+		}
+		summaries = append(summaries, summary)
+	}
+	return summaries, errors.Join(errs...)
+}
+
+// PrintPlan prints the number of rows per table which a sync would insert.
+func PrintPlan(summaries []SyncSummary) {
+	tab := table.NewWriter()
+	tab.SetOutputMirror(os.Stdout)
+	tab.AppendHeader(table.Row{"Cube", "Table", "Rows fetched", "Rows to insert", "Error"})
+	for _, summary := range summaries {
+		for _, t := range summary.Tables {
+			tab.AppendRow(table.Row{summary.Cube, t.Table, t.RowsFetched, t.RowsInserted, ""})
+		}
+		if summary.Error != "" {
+			tab.AppendRow(table.Row{summary.Cube, "", "", "", summary.Error})
+		}
+	}
+	fmt.Println("Plan:")
+	tab.Render()
+}
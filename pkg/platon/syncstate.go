@@ -0,0 +1,115 @@
+package platon
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const (
+	SyncStateTable = "platon_sync_state"
+
+	// cubeStateKey is the query key under which the watermark of the joined cube table is stored.
+	cubeStateKey = ""
+)
+
+// EnsureSyncStateTable creates the table holding the sync watermarks of all cubes and queries.
+func (p *Platon) EnsureSyncStateTable(ctx context.Context) error {
+	sql := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	Cube String,
+	Query String,
+	SyncedUntil DateTime64(3),
+	UpdatedAt DateTime64(3)
+) ENGINE = ReplacingMergeTree(UpdatedAt) ORDER BY (Cube, Query)`, quoteIdentifier(SyncStateTable))
+
+	err := p.exec(ctx, sql)
+	if err != nil {
+		return fmt.Errorf("failed to create sync state table: %w", err)
+	}
+	return nil
+}
+
+// GetSyncState returns the last successfully synced timestamp per query of a cube.
+// The watermark of the joined cube table is stored under the empty query key.
+func (p *Platon) GetSyncState(ctx context.Context, cube Cube) (map[string]time.Time, error) {
+	watermarks := map[string]time.Time{}
+	exists, err := p.TableExists(ctx, Table{Name: SyncStateTable})
+	if err != nil {
+		return nil, fmt.Errorf("failed to figure out if table %s exists: %w", SyncStateTable, err)
+	}
+	if !exists {
+		return watermarks, nil
+	}
+	sql := fmt.Sprintf("SELECT Query, max(SyncedUntil) FROM %s WHERE Cube = ? GROUP BY Query", quoteIdentifier(SyncStateTable))
+	rows, err := p.Database.Connection.Query(ctx, sql, cube.Name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query sync state of cube %s: %w", cube.Name, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			query       string
+			syncedUntil time.Time
+		)
+		if err := rows.Scan(&query, &syncedUntil); err != nil {
+			return nil, fmt.Errorf("failed to scan sync state of cube %s: %w", cube.Name, err)
+		}
+		watermarks[query] = syncedUntil
+	}
+	return watermarks, rows.Err()
+}
+
+// SetSyncState records that query of cube has been synced until the given timestamp.
+func (p *Platon) SetSyncState(ctx context.Context, cube, query string, syncedUntil time.Time) error {
+	sql := fmt.Sprintf("INSERT INTO %s (Cube, Query, SyncedUntil, UpdatedAt) VALUES (?, ?, ?, ?)", quoteIdentifier(SyncStateTable))
+	err := p.exec(ctx, sql, cube, query, syncedUntil.UTC(), time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("failed to store sync state of cube %s query %s: %w", cube, query, err)
+	}
+	return nil
+}
+
+// syncStarts returns the start of the next sync window of every query. Queries
+// without a watermark start their initial lookback before end, all others one
+// step after their watermark.
+func (c *Cube) syncStarts(watermarks map[string]time.Time, end time.Time) map[string]time.Time {
+	starts := map[string]time.Time{}
+	for _, q := range c.Queries {
+		start := end.Add(-1 * c.GetInitialLookback(q))
+		if watermark, ok := watermarks[q.Name]; ok && !watermark.IsZero() {
+			start = watermark.Add(c.GetStep(q))
+		}
+		starts[q.Name] = start
+	}
+	return starts
+}
+
+// earliestStart returns the earliest start of the sync windows of all queries.
+// The joined cube table is synced from there, rows before its watermark are skipped.
+func earliestStart(starts map[string]time.Time) time.Time {
+	earliest := time.Time{}
+	for _, start := range starts {
+		if earliest.IsZero() || start.Before(earliest) {
+			earliest = start
+		}
+	}
+	return earliest
+}
+
+// ClearSyncState removes all watermarks of a cube so it is synced from scratch when recreated.
+func (p *Platon) ClearSyncState(ctx context.Context, cube string) error {
+	exists, err := p.TableExists(ctx, Table{Name: SyncStateTable})
+	if err != nil {
+		return fmt.Errorf("failed to figure out if table %s exists: %w", SyncStateTable, err)
+	}
+	if !exists {
+		return nil
+	}
+	// Lightweight deletes hide the rows immediately, unlike the asynchronous ALTER TABLE DELETE
+	sql := fmt.Sprintf("DELETE FROM %s WHERE Cube = ?", quoteIdentifier(SyncStateTable))
+	err = p.exec(ctx, sql, cube)
+	if err != nil {
+		return fmt.Errorf("failed to clear sync state of cube %s: %w", cube, err)
+	}
+	return nil
+}
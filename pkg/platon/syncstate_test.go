@@ -0,0 +1,40 @@
+package platon
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSyncStarts(t *testing.T) {
+	end := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	cube := Cube{
+		InitialLookback: 24 * time.Hour,
+		Queries: []Query{
+			{Name: "cube-default"},
+			{Name: "short", InitialLookback: time.Hour},
+			{Name: "synced", InitialLookback: time.Hour, Step: 30 * time.Second},
+		},
+	}
+	watermarks := map[string]time.Time{
+		cubeStateKey: end.Add(-time.Hour),
+		"synced":     end.Add(-5 * time.Minute),
+	}
+
+	starts := cube.syncStarts(watermarks, end)
+	expected := map[string]time.Time{
+		"cube-default": end.Add(-24 * time.Hour),
+		"short":        end.Add(-time.Hour),
+		"synced":       end.Add(-5*time.Minute + 30*time.Second),
+	}
+	for query, start := range expected {
+		if !starts[query].Equal(start) {
+			t.Errorf("expected query %s to start at %s, got %s", query, start, starts[query])
+		}
+	}
+	if len(starts) != len(expected) {
+		t.Errorf("expected starts of %d queries, got %v", len(expected), starts)
+	}
+	if earliest := earliestStart(starts); !earliest.Equal(end.Add(-24 * time.Hour)) {
+		t.Errorf("expected the earliest start to be the cube's initial lookback, got %s", earliest)
+	}
+}
@@ -4,17 +4,26 @@ import (
 	"fmt"
 	"os"
 	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/jedib0t/go-pretty/v6/table"
 	"github.com/prometheus/common/model"
 )
 
+// LabelsColumn is the map column holding the labels of tables with TableOptions.LabelsMap.
+const LabelsColumn = "labels"
+
 type Table struct {
 	Name       string
 	Dimensions []string
 	Metrics    []string
 	Rows       []*Row
+	Options    TableOptions
+	// Start and End are the sync window the rows belong to, used to deduplicate re-syncs.
+	Start time.Time
+	End   time.Time
 }
 
 type Row struct {
@@ -27,42 +36,112 @@ type Column struct {
 	Name       string
 	DataType   string
 	ColumnType string
+	// Default is the DEFAULT expression of columns filled by ClickHouse instead of Platon.
+	Default string
+	// Nullable columns are NULL for rows without a value.
+	Nullable bool
+	// Codec is the compression codec of the column, e.g. "Delta, ZSTD".
+	Codec string
 }
 
+// GetColumns returns the columns of the table. Time has millisecond
+// precision, dimensions are LowCardinality strings and metrics are floats.
+// Types and codecs can be overridden per column, see ColumnConfig.
 func (t Table) GetColumns() []Column {
 
 	cols := []Column{}
 
-	cols = append(cols, Column{"Time", "DateTime", "Time"})
+	timeType := "DateTime64(3)"
+	if t.Options.Timezone != "" {
+		timeType = fmt.Sprintf("DateTime64(3, '%s')", t.Options.Timezone)
+	}
+	cols = append(cols, Column{Name: "Time", DataType: timeType, ColumnType: "Time"})
 	for _, dimension := range t.Dimensions {
-		cols = append(cols, Column{dimension, "String", "Dimension"})
+		if t.Options.LabelsMap && !slices.Contains(t.Options.LabelColumns, dimension) {
+			continue
+		}
+		if t.Options.NullableDimensions && !slices.Contains(t.Options.OrderBy, dimension) {
+			cols = append(cols, Column{Name: dimension, DataType: "LowCardinality(Nullable(String))", ColumnType: "Dimension", Nullable: true})
+			continue
+		}
+		cols = append(cols, Column{Name: dimension, DataType: "LowCardinality(String)", ColumnType: "Dimension"})
+	}
+	if t.Options.LabelsMap {
+		cols = append(cols, Column{Name: LabelsColumn, DataType: "Map(String, String)", ColumnType: "Labels"})
 	}
 	for _, metric := range t.Metrics {
-		cols = append(cols, Column{metric, "Float64", "Metric"})
+		if t.Options.NullableMetrics {
+			cols = append(cols, Column{Name: metric, DataType: "Nullable(Float64)", ColumnType: "Metric", Nullable: true})
+			continue
+		}
+		cols = append(cols, Column{Name: metric, DataType: "Float64", ColumnType: "Metric"})
+	}
+	if t.Options.Dedup == DedupReplacing {
+		cols = append(cols, Column{Name: VersionColumn, DataType: "UInt64", ColumnType: "Version", Default: "toUnixTimestamp64Nano(now64(9))"})
+	}
+	for i, c := range cols {
+		override, ok := t.Options.Columns[c.Name]
+		if !ok {
+			continue
+		}
+		if override.Type != "" {
+			cols[i].DataType = override.Type
+			cols[i].Nullable = strings.Contains(override.Type, "Nullable(")
+		}
+		cols[i].Codec = override.Codec
 	}
 	return cols
 }
 
-func (t Table) GetQuotedColumnNames() []string {
-
-	cols := []string{}
+// InsertColumns returns the columns Platon inserts values for, in the order of GetQuotedColumnNames.
+func (t Table) InsertColumns() []Column {
+	cols := []Column{}
+	for _, c := range t.GetColumns() {
+		if c.Default == "" {
+			cols = append(cols, c)
+		}
+	}
+	return cols
+}
 
-	cols = append(cols, "\"Time\"")
-	for _, dimension := range t.Dimensions {
-		cols = append(cols, fmt.Sprintf("\"%s\"", dimension))
+// Definition returns the column definition used in CREATE and ALTER TABLE.
+func (c Column) Definition() string {
+	definition := quoteIdentifier(c.Name) + " " + c.DataType
+	if c.Default != "" {
+		definition += " DEFAULT " + c.Default
 	}
-	for _, metric := range t.Metrics {
-		cols = append(cols, fmt.Sprintf("\"%s\"", metric))
+	if c.Codec != "" {
+		definition += " CODEC(" + c.Codec + ")"
+	}
+	return definition
+}
+
+// GetQuotedColumnNames returns the quoted names of the InsertColumns.
+func (t Table) GetQuotedColumnNames() []string {
+	cols := []string{}
+	for _, c := range t.InsertColumns() {
+		cols = append(cols, quoteIdentifier(c.Name))
 	}
 	return cols
 }
 
 func (r Row) GetOrderedValues(order []Column) []interface{} {
 	values := []interface{}{}
+	dimensionColumns := []string{}
+	for _, col := range order {
+		if col.ColumnType == "Dimension" {
+			dimensionColumns = append(dimensionColumns, col.Name)
+		}
+	}
 	for _, col := range order {
 		switch col.ColumnType {
 		case "Dimension":
-			values = append(values, r.Dimensions[col.Name])
+			val, ok := r.Dimensions[col.Name]
+			if !ok && col.Nullable {
+				values = append(values, nil)
+				continue
+			}
+			values = append(values, val)
 		case "Metric":
 			val, ok := r.Metrics[col.Name]
 			if ok {
@@ -71,6 +150,15 @@ func (r Row) GetOrderedValues(order []Column) []interface{} {
 			}
 			values = append(values, nil)
 
+		case "Labels":
+			// All dimensions without a column of their own
+			labels := map[string]string{}
+			for d, v := range r.Dimensions {
+				if !slices.Contains(dimensionColumns, d) {
+					labels[d] = v
+				}
+			}
+			values = append(values, labels)
 		case "Time":
 			values = append(values, r.Time.UTC())
 		}
@@ -79,25 +167,70 @@ func (r Row) GetOrderedValues(order []Column) []interface{} {
 	return values
 }
 
-func (t *Table) addQueryResult(query Query, queryResult model.Value) {
-	matrix := queryResult.(model.Matrix)
-	for _, sampleStream := range matrix {
-		for _, value := range sampleStream.Values {
-			timestamp := int64(value.Timestamp / 1000)
-			row := NewRow(time.Unix(timestamp, 0))
-			valueName := t.GetMetric(query.Value)
-			row.Metrics[valueName] = float64(value.Value)
-
-			for label, value := range sampleStream.Metric {
-				if string(label) == "__name__" {
-					continue
-				}
-				dimension := t.GetDimension(string(label))
-				row.Dimensions[dimension] = string(value)
+// addQueryResult adds the samples of a Prometheus query result as rows.
+// Vectors are stamped with their evaluation time, scalars and strings become
+// a single row without dimensions. Strings must hold a number.
+func (t *Table) addQueryResult(query Query, queryResult model.Value) error {
+	switch result := queryResult.(type) {
+	case model.Matrix:
+		for _, sampleStream := range result {
+			for _, value := range sampleStream.Values {
+				t.addSample(query, sampleStream.Metric, value.Timestamp, value.Value)
 			}
-			t.InsertRow(row)
 		}
+	case model.Vector:
+		for _, sample := range result {
+			t.addSample(query, sample.Metric, sample.Timestamp, sample.Value)
+		}
+	case *model.Scalar:
+		t.addSample(query, model.Metric{}, result.Timestamp, result.Value)
+	case *model.String:
+		value, err := strconv.ParseFloat(result.Value, 64)
+		if err != nil {
+			return fmt.Errorf("string result %q of query %s is not a number: %w", result.Value, query.Name, err)
+		}
+		t.addSample(query, model.Metric{}, result.Timestamp, model.SampleValue(value))
+	case nil:
+	default:
+		return fmt.Errorf("query %s returned unsupported result type %s", query.Name, queryResult.Type())
 	}
+	return nil
+}
+
+// addSample adds a row with the labels of a series as dimensions and the value as the query's metric.
+func (t *Table) addSample(query Query, labels model.Metric, timestamp model.Time, value model.SampleValue) {
+	row := NewRow(timestamp.Time())
+	valueName := t.GetMetric(query.Value)
+	row.Metrics[valueName] = float64(value)
+
+	for label, value := range labels {
+		if string(label) == "__name__" {
+			continue
+		}
+		dimension := t.GetDimension(string(label))
+		row.Dimensions[dimension] = string(value)
+	}
+	t.InsertRow(row)
+}
+
+// resultLabels returns the label sets of all series of a Prometheus query
+// result. Scalars and strings have no series.
+func resultLabels(queryResult model.Value) ([]model.Metric, error) {
+	labels := []model.Metric{}
+	switch result := queryResult.(type) {
+	case model.Matrix:
+		for _, sampleStream := range result {
+			labels = append(labels, sampleStream.Metric)
+		}
+	case model.Vector:
+		for _, sample := range result {
+			labels = append(labels, sample.Metric)
+		}
+	case *model.Scalar, *model.String, nil:
+	default:
+		return nil, fmt.Errorf("unsupported result type %s", queryResult.Type())
+	}
+	return labels, nil
 }
 
 func (t *Table) InsertRow(rowInput *Row) {
@@ -130,6 +263,18 @@ func (t *Table) PrettyPrint(limit int) {
 	tab.Render()
 }
 
+// clone returns a copy of the row which can be modified independently.
+func (r *Row) clone() *Row {
+	row := NewRow(r.Time)
+	for d, v := range r.Dimensions {
+		row.Dimensions[d] = v
+	}
+	for m, v := range r.Metrics {
+		row.Metrics[m] = v
+	}
+	return row
+}
+
 func NewRow(time time.Time) *Row {
 	row := Row{
 		Time:       time,
@@ -153,51 +298,31 @@ func (t *Table) GetMetric(metric string) string {
 	return metric
 }
 
-func (t *Table) CountMatches(dimensions []string, otherRow *Row) (count uint64, err error) {
-	for _, r := range t.Rows {
-		for _, d := range dimensions {
-			val, ok := r.Dimensions[d]
-			if !ok {
-				err = fmt.Errorf("dimension %s doesn't exist in table %s", d, t.Name)
-				return
-			}
-			otherVal, ok := otherRow.Dimensions[d]
-			if !ok {
-				err = fmt.Errorf("dimension %s doesn't exist in other row", d)
-				return
-			}
-			if val != otherVal {
-				continue
-			}
-			if r.Time != otherRow.Time {
-				continue
-			}
-		}
-		count++
+// SyncWindow returns a copy of the table for inserting the sync window
+// between start and end, containing only rows newer than the watermark.
+func (t Table) SyncWindow(start, end, watermark time.Time) Table {
+	window := t.RowsAfter(watermark)
+	window.Start = start
+	if watermark.After(start) {
+		window.Start = watermark.Add(time.Millisecond)
 	}
-
-	return
+	// Row timestamps have millisecond precision
+	window.Start = window.Start.Truncate(time.Millisecond)
+	window.End = end
+	return window
 }
 
-func (t *Table) GetFirstMatchingRow(dimensions []string, otherRow *Row) (*Row, error) {
-	for i, r := range t.Rows {
-		for _, d := range dimensions {
-			val, ok := r.Dimensions[d]
-			if !ok {
-				return nil, fmt.Errorf("dimension %s doesn't exist in table %s", d, t.Name)
-			}
-			otherVal, ok := otherRow.Dimensions[d]
-			if !ok {
-				return nil, fmt.Errorf("dimension %s doesn't exist in other row", d)
-			}
-			if val != otherVal {
-				continue
-			}
-			if r.Time != otherRow.Time {
-				continue
-			}
+// RowsAfter returns a copy of the table containing only rows newer than the given timestamp.
+func (t Table) RowsAfter(after time.Time) Table {
+	if after.IsZero() {
+		return t
+	}
+	filtered := t
+	filtered.Rows = []*Row{}
+	for _, r := range t.Rows {
+		if r.Time.After(after) {
+			filtered.Rows = append(filtered.Rows, r)
 		}
-		return t.Rows[i], nil
 	}
-	return nil, fmt.Errorf("no matching row found in table %s", t.Name)
+	return filtered
 }
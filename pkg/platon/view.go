@@ -0,0 +1,102 @@
+package platon
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	sb "github.com/huandu/go-sqlbuilder"
+)
+
+const (
+	// JoinModeMemory joins the query tables in Platon and inserts the result into the cube table.
+	JoinModeMemory = "memory"
+	// JoinModeSQL creates the cube as ClickHouse view joining the query tables.
+	JoinModeSQL = "sql"
+)
+
+var JoinModes = []string{JoinModeMemory, JoinModeSQL}
+
+// ensureView creates or replaces the view joining the query tables of a cube.
+// The view is rebuilt whenever its definition changes, e.g. because queries
+// or labels were added.
+func (p *Platon) ensureView(ctx context.Context, cube Cube, tables []Table) error {
+	viewSql, err := p.viewSql(ctx, cube, tables)
+	if err != nil {
+		return fmt.Errorf("failed to build view of cube %s: %w", cube.Name, err)
+	}
+
+	p.viewsMu.Lock()
+	defer p.viewsMu.Unlock()
+	if p.views[cube.Name] == viewSql {
+		return nil
+	}
+
+	err = p.exec(ctx, viewSql)
+	if err != nil {
+		return fmt.Errorf("failed to CREATE or UPDATE cube view: %w", err)
+	}
+	if !p.DryRun {
+		p.views[cube.Name] = viewSql
+	}
+	return nil
+}
+
+// viewSql returns the statement creating the cube view. Each query table is
+// aggregated to the joined labels and Time using the query's aggregation,
+// and the aggregated tables are full outer joined on these columns.
+func (p *Platon) viewSql(ctx context.Context, cube Cube, tables []Table) (string, error) {
+	joinCols := quoteIdentifiers(append(slices.Clone(cube.JoinedLabels), "Time"))
+
+	selects := []string{}
+	for _, query := range cube.Queries {
+		i := slices.IndexFunc(tables, func(t Table) bool { return t.Name == query.Name })
+		if i < 0 {
+			return "", fmt.Errorf("no table for query %s", query.Name)
+		}
+		columns, err := p.tableColumns(ctx, tables[i])
+		if err != nil {
+			return "", err
+		}
+
+		cols := []string{}
+		for _, label := range cube.JoinedLabels {
+			if slices.ContainsFunc(columns, func(c Column) bool { return c.Name == label }) {
+				cols = append(cols, quoteIdentifier(label))
+				continue
+			}
+			// Missing labels are empty, like in the in-memory join
+			cols = append(cols, fmt.Sprintf("'' AS %s", quoteIdentifier(label)))
+		}
+		cols = append(cols, quoteIdentifier("Time"))
+		aggregation := strings.ToUpper(cube.GetAggregation(query.Name))
+		if aggregation == "" {
+			aggregation = "SUM"
+		}
+		value := quoteIdentifier(query.Value)
+		cols = append(cols, fmt.Sprintf("%s(%s) AS %s", aggregation, value, value))
+
+		selectSql, _ := sb.ClickHouse.NewSelectBuilder().Select(cols...).From(quoteIdentifier(query.Name)).GroupBy(joinCols...).Build()
+		selects = append(selects, selectSql)
+	}
+
+	viewSql := "CREATE OR REPLACE VIEW " + quoteIdentifier(cube.Name) + " AS SELECT * FROM (" + selects[0] + ") T0"
+	for i, selectSql := range selects[1:] {
+		viewSql += fmt.Sprintf(" FULL OUTER JOIN (%s) T%d USING (%s)", selectSql, i+1, strings.Join(joinCols, ", "))
+	}
+	return viewSql, nil
+}
+
+// tableColumns returns the columns of a table in ClickHouse, or the columns
+// of the in-memory table if it hasn't been created yet.
+func (p *Platon) tableColumns(ctx context.Context, table Table) ([]Column, error) {
+	exists, err := p.TableExists(ctx, table)
+	if err != nil {
+		return nil, fmt.Errorf("failed to figure out if table %s exists: %w", table.Name, err)
+	}
+	if !exists {
+		return table.GetColumns(), nil
+	}
+	return p.DescribeTable(ctx, table.Name)
+}